@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewAdminMux returns the handlers of the internal admin interface. It must
+// not be exposed publicly.
+//
+//	GET  /admin/conns                     list live connections
+//	POST /admin/conns/kick?id=<conn-id>   close a connection
+//	POST /admin/conns/kick?sid=<sid>      close all connections of a session
+func NewAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/conns", listConnsHandler)
+	mux.HandleFunc("/admin/conns/kick", kickConnHandler)
+	return mux
+}
+
+func listConnsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, registry.List())
+}
+
+func kickConnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, sid := r.FormValue("id"), r.FormValue("sid")
+	if id == "" && sid == "" {
+		http.Error(w, "id or sid required", http.StatusBadRequest)
+		return
+	}
+	kicked := []string{}
+	for _, c := range registry.Find(id, sid) {
+		log.Printf("admin: closing connection %s from %s", c.ID, c.RemoteAddr)
+		c.kick(websocket.ClosePolicyViolation, "closed by admin")
+		kicked = append(kicked, c.ID)
+	}
+	if len(kicked) == 0 {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"kicked": kicked})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("admin: could not encode response", err)
+	}
+}
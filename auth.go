@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// modes of handshake authentication (-auth)
+const (
+	authOff      = "off"
+	authOptional = "optional"
+	authRequired = "required"
+)
+
+// subprotoBearer prefixes a token sent as WebSocket subprotocol, for
+// browser clients which cannot set the Authorization header. Such clients
+// must offer a regular subprotocol (e.g. "hync") as well, since the server
+// never selects this one.
+const subprotoBearer = "hync.bearer."
+
+// Identity is the authenticated owner of a connection.
+type Identity struct {
+	Kind string `json:"kind"`
+	UID  string `json:"uid,omitempty"`
+}
+
+func (id *Identity) String() string {
+	if id == nil {
+		return "anonymous"
+	}
+	return fmt.Sprintf("%s:%s", id.Kind, id.UID)
+}
+
+// TokenStore looks up the identity behind a (plain) token.
+type TokenStore interface {
+	Lookup(token string) (*Identity, error)
+}
+
+// errUnknownToken is returned by TokenStores for tokens they don't know.
+var errUnknownToken = errors.New("unknown token")
+
+// sqlTokenStore reads diffsync's tokens table. Tokens are stored as hex
+// encoded SHA-512 hash of their raw bytes, see generateToken. Only session
+// and anon tokens which are neither consumed nor expired authenticate a
+// client; other kinds (e.g. invite or login tokens) are meant to be consumed
+// in a session, not to open a connection.
+type sqlTokenStore struct {
+	db *sql.DB
+}
+
+func (s sqlTokenStore) Lookup(token string) (*Identity, error) {
+	raw, err := hex.DecodeString(token)
+	if err != nil {
+		return nil, errUnknownToken
+	}
+	h := sha512.Sum512(raw)
+	id := &Identity{}
+	err = s.db.QueryRow(`SELECT kind, COALESCE(uid, '') FROM tokens
+		WHERE token = $1 AND kind IN ('session', 'anon') AND consumed_at IS NULL
+		AND (valid_until IS NULL OR valid_until > now())`, hex.EncodeToString(h[:])).Scan(&id.Kind, &id.UID)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownToken
+	}
+	return id, err
+}
+
+// authError is a failed authentication, answered with Status.
+type authError struct {
+	Status int
+	Reason string
+}
+
+func (e *authError) Error() string {
+	return e.Reason
+}
+
+// Authenticator validates the credentials of a request before it is
+// upgraded. Credentials are a token, taken from (in this order)
+//
+//	Authorization: Bearer <token>
+//	Sec-WebSocket-Protocol: hync.bearer.<token>
+//	the -auth_cookie cookie, signed as <token>.<hex HMAC-SHA256(token)>
+//	?access_token=<token>
+//
+// A nil Authenticator accepts all requests anonymously.
+type Authenticator struct {
+	tokens   TokenStore
+	required bool
+	kinds    []string
+	cookie   string
+	secret   []byte
+}
+
+func NewAuthenticator(tokens TokenStore, mode string, kinds []string, cookie string, secret []byte) (*Authenticator, error) {
+	switch mode {
+	case authOff:
+		return nil, nil
+	case authOptional, authRequired:
+	default:
+		return nil, fmt.Errorf("invalid auth mode `%s`, must be one of %s, %s, %s", mode, authOff, authOptional, authRequired)
+	}
+	return &Authenticator{tokens: tokens, required: mode == authRequired, kinds: kinds, cookie: cookie, secret: secret}, nil
+}
+
+// Authenticate returns the identity of the client which sent r, or nil for
+// anonymous clients if authentication is optional.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if a == nil {
+		return nil, nil
+	}
+	token, err := a.credentials(r)
+	if err != nil {
+		count("auth_invalid")
+		return nil, err
+	}
+	return a.identify(token)
+}
+
+// identify returns the identity behind token; an empty token means the
+// client sent no credentials.
+func (a *Authenticator) identify(token string) (*Identity, error) {
+	if token == "" {
+		if a.required {
+			count("auth_missing")
+			return nil, &authError{http.StatusUnauthorized, "authentication required"}
+		}
+		return nil, nil
+	}
+	id, err := a.tokens.Lookup(token)
+	if err == errUnknownToken {
+		count("auth_invalid")
+		return nil, &authError{http.StatusUnauthorized, "invalid token"}
+	} else if err != nil {
+		log.Println("auth: token lookup failed:", err)
+		return nil, &authError{http.StatusServiceUnavailable, "cannot validate token"}
+	}
+	if len(a.kinds) > 0 && !contains(a.kinds, id.Kind) {
+		count("auth_forbidden")
+		return nil, &authError{http.StatusForbidden, fmt.Sprintf("tokens of kind `%s` not accepted", id.Kind)}
+	}
+	count("auth_ok")
+	return id, nil
+}
+
+// credentials extracts the token from r; an empty token means none was
+// sent.
+func (a *Authenticator) credentials(r *http.Request) (string, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if !strings.HasPrefix(h, "Bearer ") {
+			return "", &authError{http.StatusUnauthorized, "unsupported authorization scheme"}
+		}
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")), nil
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, subprotoBearer) {
+			return strings.TrimPrefix(p, subprotoBearer), nil
+		}
+	}
+	if c, err := r.Cookie(a.cookie); err == nil && c.Value != "" {
+		token, ok := a.verifyCookie(c.Value)
+		if !ok {
+			return "", &authError{http.StatusUnauthorized, "invalid auth cookie"}
+		}
+		return token, nil
+	}
+	return r.URL.Query().Get("access_token"), nil
+}
+
+// usesCookies reports whether credentials can come in a cookie, which
+// cross-origin requests only send if CORS allows credentials.
+func (a *Authenticator) usesCookies() bool {
+	return a != nil && a.cookie != ""
+}
+
+func (a *Authenticator) sign(token string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(token))
+	return token + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *Authenticator) verifyCookie(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 || len(a.secret) == 0 {
+		return "", false
+	}
+	token := value[:i]
+	return token, hmac.Equal([]byte(a.sign(token)), []byte(value))
+}
+
+// rejectAuth answers a request which failed authentication.
+func rejectAuth(w http.ResponseWriter, err error) {
+	aerr, ok := err.(*authError)
+	if !ok {
+		aerr = &authError{http.StatusUnauthorized, err.Error()}
+	}
+	if aerr.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="hync", error_description="%s"`, aerr.Reason))
+	}
+	http.Error(w, aerr.Reason, aerr.Status)
+}
+
+// newAuthenticator applies the -auth* flags.
+func newAuthenticator(db *sql.DB) (*Authenticator, error) {
+	kinds := []string{}
+	for _, k := range strings.Split(*authKinds, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			kinds = append(kinds, k)
+		}
+	}
+	return NewAuthenticator(sqlTokenStore{db}, *authMode, kinds, *authCookie, []byte(*authSecret))
+}
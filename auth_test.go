@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type mapTokenStore map[string]*Identity
+
+func (m mapTokenStore) Lookup(token string) (*Identity, error) {
+	if id, ok := m[token]; ok {
+		return id, nil
+	}
+	return nil, errUnknownToken
+}
+
+func TestAuthenticate(t *testing.T) {
+	tokens := mapTokenStore{
+		"usertok": {Kind: "login", UID: "u1"},
+		"anontok": {Kind: "anon"},
+	}
+	a, err := NewAuthenticator(tokens, authRequired, []string{"login"}, "hync_auth", []byte("secret"))
+	assert(t, err == nil, "unexpected error %s", err)
+
+	cases := []struct {
+		setup  func(r *http.Request)
+		status int
+		uid    string
+	}{
+		{func(r *http.Request) {}, http.StatusUnauthorized, ""},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer usertok") }, 0, "u1"},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Basic dXNlcg==") }, http.StatusUnauthorized, ""},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized, ""},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer anontok") }, http.StatusForbidden, ""},
+		{func(r *http.Request) { r.Header.Set("Sec-Websocket-Protocol", "hync, hync.bearer.usertok") }, 0, "u1"},
+		{func(r *http.Request) { r.URL.RawQuery = "access_token=usertok" }, 0, "u1"},
+		{func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "hync_auth", Value: a.sign("usertok")}) }, 0, "u1"},
+		{func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "hync_auth", Value: "usertok.00"}) }, http.StatusUnauthorized, ""},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/1/ws", nil)
+		c.setup(r)
+		id, err := a.Authenticate(r)
+		if c.status != 0 {
+			aerr, ok := err.(*authError)
+			assert(t, ok && aerr.Status == c.status, "case %d: expected status %d, got %v", i, c.status, err)
+			continue
+		}
+		assert(t, err == nil && id != nil && id.UID == c.uid, "case %d: expected uid %s, got %v (%v)", i, c.uid, id, err)
+	}
+}
+
+func TestAuthenticateOptional(t *testing.T) {
+	a, _ := NewAuthenticator(mapTokenStore{}, authOptional, nil, "hync_auth", nil)
+	id, err := a.Authenticate(httptest.NewRequest("GET", "/1/ws", nil))
+	assert(t, id == nil && err == nil, "anonymous clients should pass in optional mode")
+	off, err := NewAuthenticator(mapTokenStore{}, authOff, nil, "", nil)
+	assert(t, off == nil && err == nil, "mode off should yield no authenticator")
+	_, err = NewAuthenticator(mapTokenStore{}, "sometimes", nil, "", nil)
+	assert(t, err != nil, "invalid mode should be rejected")
+}
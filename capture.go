@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic capture records the frames of selected WebSocket connections, so
+// that sync bugs can be reproduced with `hync replay`. A connection is
+// captured if it was picked by -capture_sample, comes from one of
+// -capture_ips, or (from then on) sent a message for one of -capture_sids.
+//
+// The capture file holds one JSON record per line (see captureRecord). It is
+// rotated once it grows beyond -capture_max_size; all values of fields
+// named like "token" are redacted. Frames are recorded as sent on the wire,
+// unless they had to be redacted: those are encoded again with the
+// connection's codec after redaction. Malformed frames, which cannot be
+// redacted, are only recorded with their length and SHA-256 hash.
+
+// captureRecord is a line of the capture file. Kind is "open", "in", "out"
+// or "close"; Frame is the frame in the connection's codec (given with
+// "open"), Msgs the frame as list of JSON messages for reading.
+type captureRecord struct {
+	Time    time.Time         `json:"t"`
+	Conn    string            `json:"conn"`
+	Kind    string            `json:"kind"`
+	Path    string            `json:"path,omitempty"`
+	Version int               `json:"version"`
+	Codec   string            `json:"codec,omitempty"`
+	Frame   []byte            `json:"frame,omitempty"`
+	Msgs    []json.RawMessage `json:"msgs,omitempty"`
+}
+
+// redacted replaces the values of token fields in captured messages.
+const redacted = "[redacted]"
+
+// captureLog is an append-only file which is rotated when it gets too big:
+// path.1 is the previous file, path.2 the one before and so on.
+type captureLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func openCaptureLog(path string, maxSize int64, keep int) (*captureLog, error) {
+	cf := &captureLog{path: path, maxSize: maxSize, keep: keep}
+	if err := cf.open(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (cf *captureLog) open() error {
+	f, err := os.OpenFile(cf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	cf.f, cf.size = f, fi.Size()
+	return nil
+}
+
+func (cf *captureLog) rotate() error {
+	cf.f.Close()
+	for i := cf.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", cf.path, i), fmt.Sprintf("%s.%d", cf.path, i+1))
+	}
+	if cf.keep > 0 {
+		os.Rename(cf.path, cf.path+".1")
+	} else {
+		os.Remove(cf.path)
+	}
+	return cf.open()
+}
+
+func (cf *captureLog) Write(rec captureRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.maxSize > 0 && cf.size+int64(len(line)) >= cf.maxSize {
+		if err := cf.rotate(); err != nil {
+			return err
+		}
+		count("capture_rotations")
+	}
+	n, err := cf.f.Write(append(line, '\n'))
+	cf.size += int64(n)
+	return err
+}
+
+func (cf *captureLog) Close() error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.f.Close()
+}
+
+// capturer decides which connections are captured.
+type capturer struct {
+	file   *captureLog
+	sids   map[string]bool
+	ips    map[string]bool
+	sample float64
+}
+
+// capture is nil unless -capture_file is set.
+var capture *capturer
+
+func setupCapture() error {
+	if *captureFile == "" {
+		return nil
+	}
+	if *captureSample < 0 || *captureSample > 1 {
+		return fmt.Errorf("-capture_sample must be between 0 and 1")
+	}
+	f, err := openCaptureLog(*captureFile, *captureMaxSize<<20, *captureKeep)
+	if err != nil {
+		return err
+	}
+	capture = &capturer{file: f, sids: splitSet(*captureSIDs), ips: splitSet(*captureIPs), sample: *captureSample}
+	log.Printf("capturing traffic to %s", *captureFile)
+	return nil
+}
+
+func splitSet(spec string) map[string]bool {
+	set := map[string]bool{}
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+// captureConn captures the frames of a single connection.
+type captureConn struct {
+	*capturer
+	info    *connInfo
+	path    string
+	version int
+	codec   Codec
+	name    string
+	on      int32
+}
+
+// newCaptureConn returns nil if capturing is disabled.
+func (c *capturer) newCaptureConn(info *connInfo, ip, path string, version int, codec Codec, codecName string) *captureConn {
+	if c == nil {
+		return nil
+	}
+	cc := &captureConn{capturer: c, info: info, path: path, version: version, codec: codec, name: codecName}
+	if c.ips[ip] || (c.sample > 0 && rand.Float64() < c.sample) {
+		cc.start()
+	}
+	return cc
+}
+
+func (cc *captureConn) start() {
+	if !atomic.CompareAndSwapInt32(&cc.on, 0, 1) {
+		return
+	}
+	count("capture_conns")
+	cc.write(captureRecord{Kind: "open", Path: cc.path, Codec: cc.name}, nil, nil)
+}
+
+// write records frame, which is made of msgs. If msgs have to be redacted,
+// the frame is encoded again from the redacted messages.
+func (cc *captureConn) write(rec captureRecord, frame []byte, msgs [][]byte) {
+	rec.Time, rec.Conn, rec.Version = time.Now(), cc.info.ID, cc.version
+	changed := false
+	for _, msg := range msgs {
+		jsonMsg, err := cc.codec.ToJSON(msg)
+		if err != nil {
+			// keep the position of the frame, even if it is unreadable
+			jsonMsg, _ = json.Marshal(fmt.Sprintf("unreadable: %s", err))
+			frame = nil
+		}
+		redactedMsg, ok := redact(jsonMsg)
+		rec.Msgs = append(rec.Msgs, redactedMsg)
+		changed = changed || ok
+	}
+	if frame != nil && changed {
+		frame = cc.encode(rec.Msgs)
+	}
+	rec.Frame = frame
+	if err := cc.file.Write(rec); err != nil {
+		log.Println("capture: write failed:", err)
+	}
+}
+
+// encode encodes JSON messages as frame in the connection's codec, or
+// returns nil if that fails.
+func (cc *captureConn) encode(jsonMsgs []json.RawMessage) []byte {
+	msgs := [][]byte{}
+	for _, jsonMsg := range jsonMsgs {
+		msg, err := cc.codec.FromJSON(jsonMsg)
+		if err != nil {
+			return nil
+		}
+		msgs = append(msgs, msg)
+	}
+	frame, err := cc.codec.Mux(msgs)
+	if err != nil {
+		return nil
+	}
+	return frame
+}
+
+// Frame records a frame of the given direction ("in" or "out").
+func (cc *captureConn) Frame(kind string, frame []byte) {
+	if cc == nil || (atomic.LoadInt32(&cc.on) == 0 && len(cc.sids) == 0) {
+		return
+	}
+	msgs, err := cc.codec.Demux(frame)
+	if atomic.LoadInt32(&cc.on) == 0 {
+		if kind != "in" || !cc.wantSID(msgs) {
+			return
+		}
+		cc.start()
+	}
+	if err != nil {
+		// malformed frames cannot be redacted, only their fingerprint is
+		// recorded
+		cc.write(captureRecord{Kind: kind, Msgs: []json.RawMessage{fingerprint(frame)}}, nil, nil)
+		return
+	}
+	cc.write(captureRecord{Kind: kind}, frame, msgs)
+}
+
+// wantSID reports whether one of msgs belongs to a session in -capture_sids.
+func (cc *captureConn) wantSID(msgs [][]byte) bool {
+	for _, msg := range msgs {
+		jsonMsg, err := cc.codec.ToJSON(msg)
+		if err != nil {
+			continue
+		}
+		sid := struct {
+			SID string `json:"sid"`
+		}{}
+		if json.Unmarshal(jsonMsg, &sid) == nil && cc.sids[sid.SID] {
+			return true
+		}
+	}
+	return false
+}
+
+// Close records the end of the connection.
+func (cc *captureConn) Close() {
+	if cc == nil || atomic.LoadInt32(&cc.on) == 0 {
+		return
+	}
+	cc.write(captureRecord{Kind: "close"}, nil, nil)
+}
+
+// redact replaces the values of all fields whose name contains "token".
+// Messages which cannot be parsed are replaced by their fingerprint. It
+// reports whether anything was replaced.
+func redact(jsonMsg []byte) (json.RawMessage, bool) {
+	var v interface{}
+	if err := json.Unmarshal(jsonMsg, &v); err != nil {
+		return fingerprint(jsonMsg), true
+	}
+	changed := false
+	out, err := json.Marshal(redactValue(v, &changed))
+	if err != nil {
+		return fingerprint(jsonMsg), true
+	}
+	return out, changed
+}
+
+// fingerprint returns a JSON string with the length and hash of data, for
+// data which may hold tokens but cannot be redacted.
+func fingerprint(data []byte) json.RawMessage {
+	sum := sha256.Sum256(data)
+	quoted, _ := json.Marshal(fmt.Sprintf("malformed: %d bytes, sha256 %x", len(data), sum))
+	return quoted
+}
+
+func redactValue(v interface{}, changed *bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k := range v {
+			if strings.Contains(strings.ToLower(k), "token") {
+				v[k], *changed = redacted, true
+				continue
+			}
+			v[k] = redactValue(v[k], changed)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i], changed)
+		}
+	}
+	return v
+}
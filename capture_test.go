@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	msg, changed := redact([]byte(`{"name":"session-create","token":"secret","session":{"tokens":["a"],"sid":"s"}}`))
+	assert(t, changed && !strings.Contains(string(msg), "secret") && !strings.Contains(string(msg), `"a"`), "token not redacted: %s", msg)
+	assert(t, strings.Contains(string(msg), `"sid":"s"`), "other fields should be kept: %s", msg)
+	msg, changed = redact([]byte(`{"token":"secret"`))
+	assert(t, changed && !strings.Contains(string(msg), "secret") && strings.Contains(string(msg), "17 bytes"), "unparsable message not replaced by fingerprint: %s", msg)
+	_, changed = redact([]byte(`{"name":"res-sync","sid":"s"}`))
+	assert(t, !changed, "message without token should be kept")
+}
+
+func TestCaptureBySID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.log")
+	f, err := openCaptureLog(path, 300, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &capturer{file: f, sids: map[string]bool{"s1": true}}
+	cc := c.newCaptureConn(newConnInfo("ws", "127.0.0.1:1", "test"), "127.0.0.1", "/1/ws", 1, codecs["json"], "json")
+
+	cc.Frame("in", []byte(`[{"name":"client-ehlo","sid":"other"}]`))
+	cc.Frame("out", []byte(`[{"name":"session-create","sid":"other"}]`))
+	cc.Frame("in", []byte(`[{"name":"client-ehlo","sid":"s1","token":"secret"}]`))
+	cc.Frame("out", []byte(`[{"name":"res-sync","sid":"s1"}]`))
+	cc.Frame("in", []byte(`[{"name":"client-ehlo","sid":"s1","token":"secret"`))
+	cc.Close()
+	f.Close()
+
+	kinds, frames := []string{}, []string{}
+	for _, p := range []string{path + ".4", path + ".3", path + ".2", path + ".1", path} {
+		data, _ := ioutil.ReadFile(p)
+		assert(t, !strings.Contains(string(data), "secret"), "token leaked into capture")
+		lines := bufio.NewScanner(strings.NewReader(string(data)))
+		for lines.Scan() {
+			rec := captureRecord{}
+			err := json.Unmarshal(lines.Bytes(), &rec)
+			assert(t, err == nil, "invalid record %s", lines.Bytes())
+			kinds = append(kinds, rec.Kind)
+			frames = append(frames, string(rec.Frame))
+		}
+	}
+	assert(t, strings.Join(kinds, ",") == "open,in,out,in,close", "unexpected records %v", kinds)
+	if len(frames) == 5 {
+		assert(t, !strings.Contains(frames[1], "secret") && strings.Contains(frames[1], redacted), "frame with token should be redacted: %s", frames[1])
+		assert(t, frames[2] == `[{"name":"res-sync","sid":"s1"}]`, "frame should be recorded as sent: %s", frames[2])
+		assert(t, frames[3] == "", "malformed frame should not be recorded: %s", frames[3])
+	}
+	_, err = os.Stat(path + ".1")
+	assert(t, err == nil, "capture file should have been rotated")
+}
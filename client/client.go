@@ -0,0 +1,514 @@
+// Package client talks the hync sync protocol over WebSocket, so that Go
+// tools don't have to hand-roll the JSON messages html/client.html builds.
+//
+//	c := client.New("ws://localhost:8888/1/ws", 1)
+//	if err := c.Connect(); err != nil { ... }
+//	defer c.Close()
+//	sub := c.Subscribe("res-sync")
+//	sess, err := c.CreateSession(anonToken)
+//	err = c.Sync("note", "aaaaa", []client.Edit{{Delta: client.Delta(`"=4\t+x"`)}})
+//	msg := <-sub.C
+//
+// The client reconnects with exponential backoff if the connection breaks
+// and restores its session: with protocol v1 or later it resumes the
+// session and gets the events it missed, otherwise (or if hync asks for a
+// full resync) it sends client-ehlo.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrNotConnected = errors.New("client: not connected")
+	ErrConnected    = errors.New("client: already connected")
+	ErrNoSession    = errors.New("client: no session, create one first")
+	ErrClosed       = errors.New("client: closed")
+	ErrTimeout      = errors.New("client: timeout waiting for reply")
+)
+
+// Clock is the version vector of a shadow (client and server version).
+type Clock struct {
+	CV int64 `json:"cv"`
+	SV int64 `json:"sv"`
+}
+
+// Edit is an entry of a client's send-queue for a resource.
+type Edit struct {
+	Clock Clock           `json:"clock"`
+	Delta json.RawMessage `json:"delta"`
+}
+
+// Delta wraps a JSON encoded delta, e.g. Delta(`{"text": "=2\t+Bar\t=2"}`).
+func Delta(s string) json.RawMessage {
+	return json.RawMessage(s)
+}
+
+// Res identifies a resource.
+type Res struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// Session is the session state sent by hync on session-create.
+type Session struct {
+	SID string `json:"sid"`
+	// Raw is the complete session state as sent by hync
+	Raw json.RawMessage `json:"-"`
+}
+
+// Message is a single message of the sync protocol in either direction.
+type Message struct {
+	Name    string          `json:"name"`
+	SID     string          `json:"sid"`
+	Tag     string          `json:"tag"`
+	Token   string          `json:"token,omitempty"`
+	Res     *Res            `json:"res,omitempty"`
+	Changes []Edit          `json:"changes,omitempty"`
+	Session json.RawMessage `json:"session,omitempty"`
+	// Seq numbers the events of resumable sessions (protocol v1)
+	Seq     uint64 `json:"seq,omitempty"`
+	LastSeq uint64 `json:"last_seq,omitempty"`
+	// Status and Code are set on session-resume replies and errors
+	Status string `json:"status,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Raw is the message as received from hync
+	Raw json.RawMessage `json:"-"`
+}
+
+// Subscription receives incoming messages. C must be drained: messages
+// for a subscription whose buffer is full are dropped.
+type Subscription struct {
+	C     <-chan Message
+	c     chan Message
+	names []string
+	cl    *Client
+}
+
+// Close stops the subscription.
+func (s *Subscription) Close() {
+	s.cl.mu.Lock()
+	defer s.cl.mu.Unlock()
+	for i := range s.cl.subs {
+		if s.cl.subs[i] == s {
+			s.cl.subs = append(s.cl.subs[:i], s.cl.subs[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+func (s *Subscription) wants(name string) bool {
+	if len(s.names) == 0 {
+		return true
+	}
+	for _, n := range s.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Client is a connection to hync which survives reconnects. The exported
+// fields must be set before calling Connect.
+type Client struct {
+	URL string
+	// Protocol is the version of the sync protocol; clients speaking v1 or
+	// later can resume their session after reconnecting
+	Protocol int
+	Header   http.Header
+	Dialer   *websocket.Dialer
+	// reconnect delays start at MinBackoff and double up to MaxBackoff
+	MinBackoff, MaxBackoff time.Duration
+	// Timeout limits how long Request waits for a reply
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	wmu     sync.Mutex
+	conn    *websocket.Conn
+	subs    []*Subscription
+	sid     string
+	lastSeq uint64
+	tags    int64
+	running bool
+	closed  chan struct{}
+	up      chan struct{}
+}
+
+// New returns a client speaking protocol version protocol with the hync
+// WebSocket endpoint at url, e.g. ws://localhost:8888/1/ws.
+func New(url string, protocol int) *Client {
+	return &Client{
+		URL:        url,
+		Protocol:   protocol,
+		Header:     http.Header{},
+		Dialer:     websocket.DefaultDialer,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Timeout:    10 * time.Second,
+		closed:     make(chan struct{}),
+		up:         make(chan struct{}),
+	}
+}
+
+// Connect dials hync. Later connection losses are handled in the
+// background until Close is called.
+func (c *Client) Connect() error {
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return ErrClosed
+	default:
+	}
+	if c.running {
+		c.mu.Unlock()
+		return ErrConnected
+	}
+	c.running = true
+	c.mu.Unlock()
+	conn, err := c.dial()
+	if err != nil {
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+		return err
+	}
+	go c.run(conn)
+	return nil
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	for _, s := range c.subs {
+		close(s.c)
+	}
+	c.subs = nil
+	if c.conn == nil {
+		return nil
+	}
+	c.wmu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wmu.Unlock()
+	return c.conn.Close()
+}
+
+// Connected returns a channel which is closed once the client is (re)connected.
+func (c *Client) Connected() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.up
+}
+
+// SID returns the id of the current session, if any.
+func (c *Client) SID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sid
+}
+
+// Subscribe returns a subscription to incoming messages with the given
+// names, or to all messages if no names are given.
+func (c *Client) Subscribe(names ...string) *Subscription {
+	ch := make(chan Message, 64)
+	s := &Subscription{C: ch, c: ch, names: names, cl: c}
+	c.mu.Lock()
+	c.subs = append(c.subs, s)
+	c.mu.Unlock()
+	return s
+}
+
+// Send sends msgs as a single message list. Messages without tag get a
+// fresh one.
+func (c *Client) Send(msgs ...Message) error {
+	for i := range msgs {
+		if msgs[i].Tag == "" {
+			msgs[i].Tag = c.newTag()
+		}
+	}
+	frame, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return conn.WriteMessage(websocket.TextMessage, frame)
+}
+
+// Request sends msg and waits for hync's reply, i.e. the first message
+// with the same name and tag, or an error message with the same tag.
+func (c *Client) Request(msg Message) (Message, error) {
+	if msg.Tag == "" {
+		msg.Tag = c.newTag()
+	}
+	sub := c.Subscribe(msg.Name, "error")
+	defer sub.Close()
+	if err := c.Send(msg); err != nil {
+		return Message{}, err
+	}
+	timeout := time.After(c.Timeout)
+	for {
+		select {
+		case reply, ok := <-sub.C:
+			if !ok {
+				return Message{}, ErrClosed
+			}
+			if reply.Tag != msg.Tag {
+				continue
+			}
+			if reply.Name == "error" {
+				return reply, fmt.Errorf("client: %s failed: %s (%s)", msg.Name, reply.Reason, reply.Code)
+			}
+			return reply, nil
+		case <-timeout:
+			return Message{}, ErrTimeout
+		}
+	}
+}
+
+// CreateSession creates a new session with token and makes it the
+// client's session.
+func (c *Client) CreateSession(token string) (*Session, error) {
+	reply, err := c.Request(Message{Name: "session-create", Token: token})
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{Raw: reply.Session}
+	if err := json.Unmarshal(reply.Session, sess); err != nil {
+		return nil, fmt.Errorf("client: invalid session in reply: %s", err)
+	}
+	c.mu.Lock()
+	c.sid, c.lastSeq = sess.SID, 0
+	c.mu.Unlock()
+	return sess, nil
+}
+
+// ResumeSession makes sid the client's session, e.g. one created by an
+// earlier process, and announces it to hync with client-ehlo.
+func (c *Client) ResumeSession(sid string) error {
+	c.mu.Lock()
+	c.sid, c.lastSeq = sid, 0
+	c.mu.Unlock()
+	return c.Ehlo()
+}
+
+// Ehlo sends client-ehlo for the current session.
+func (c *Client) Ehlo() error {
+	sid := c.SID()
+	if sid == "" {
+		return ErrNoSession
+	}
+	return c.Send(Message{Name: "client-ehlo", SID: sid})
+}
+
+// Sync sends the send-queue changes of a resource with res-sync.
+func (c *Client) Sync(kind, id string, changes []Edit) error {
+	sid := c.SID()
+	if sid == "" {
+		return ErrNoSession
+	}
+	return c.Send(Message{Name: "res-sync", SID: sid, Res: &Res{Kind: kind, ID: id}, Changes: changes})
+}
+
+// ConsumeToken consumes token (e.g. an invite or login token) in the
+// current session.
+func (c *Client) ConsumeToken(token string) error {
+	sid := c.SID()
+	if sid == "" {
+		return ErrNoSession
+	}
+	return c.Send(Message{Name: "token-consume", SID: sid, Token: token})
+}
+
+func (c *Client) newTag() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tags++
+	return "go" + strconv.FormatInt(c.tags, 36)
+}
+
+func (c *Client) dial() (*websocket.Conn, error) {
+	header := http.Header{}
+	for k, vs := range c.Header {
+		header[k] = vs
+	}
+	if c.Protocol > 0 {
+		// the subprotocol takes precedence over the route's version
+		header.Set("Sec-Websocket-Protocol", "hync.v"+strconv.Itoa(c.Protocol))
+	}
+	conn, _, err := c.Dialer.Dial(c.URL, header)
+	if err != nil {
+		return nil, err
+	}
+	if c.Protocol > 0 && conn.Subprotocol() != header.Get("Sec-Websocket-Protocol") {
+		conn.Close()
+		return nil, fmt.Errorf("client: hync does not speak protocol version %d", c.Protocol)
+	}
+	c.mu.Lock()
+	c.conn = conn
+	select {
+	case <-c.up:
+	default:
+		close(c.up)
+	}
+	c.mu.Unlock()
+	return conn, nil
+}
+
+// run reads from conn and reconnects if it breaks.
+func (c *Client) run(conn *websocket.Conn) {
+	for {
+		retry := c.read(conn)
+		c.mu.Lock()
+		c.conn = nil
+		c.up = make(chan struct{})
+		c.mu.Unlock()
+		conn.Close()
+		if conn = c.reconnect(retry); conn == nil {
+			return
+		}
+		// restore waits for replies, which are dispatched by read
+		go c.restore()
+	}
+}
+
+// restartRetry parses hync's "server-restarting, retry after N ms".
+var restartRetry = regexp.MustCompile(`retry after (\d+) ms`)
+
+// read dispatches incoming messages until the connection breaks. It
+// returns how long hync asked us to wait before reconnecting.
+func (c *Client) read(conn *websocket.Conn) time.Duration {
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			if ce, ok := err.(*websocket.CloseError); ok {
+				if m := restartRetry.FindStringSubmatch(ce.Text); m != nil {
+					ms, _ := strconv.Atoi(m[1])
+					return time.Duration(ms) * time.Millisecond
+				}
+			}
+			return 0
+		}
+		raw := []json.RawMessage{}
+		if err := json.Unmarshal(frame, &raw); err != nil {
+			log.Println("client: invalid message list from hync:", err)
+			continue
+		}
+		acked := uint64(0)
+		for i := range raw {
+			msg := Message{Raw: raw[i]}
+			if err := json.Unmarshal(raw[i], &msg); err != nil {
+				log.Println("client: invalid message from hync:", err)
+				continue
+			}
+			if msg.Seq > 0 {
+				acked = msg.Seq
+			}
+			c.dispatch(msg)
+		}
+		if acked > 0 {
+			c.mu.Lock()
+			c.lastSeq = acked
+			sid := c.sid
+			c.mu.Unlock()
+			c.Send(Message{Name: "session-ack", SID: sid, Seq: acked})
+		}
+	}
+}
+
+// dispatch passes msg to the subscriptions which want it. It must not
+// block, as Subscription.Close waits for c.mu.
+func (c *Client) dispatch(msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.subs {
+		if !s.wants(msg.Name) {
+			continue
+		}
+		select {
+		case s.c <- msg:
+		default:
+			log.Printf("client: subscription full, dropping %s message", msg.Name)
+		}
+	}
+}
+
+// reconnect redials with exponential backoff, waiting at least retry.
+func (c *Client) reconnect(retry time.Duration) *websocket.Conn {
+	backoff := c.MinBackoff
+	wait := retry
+	for {
+		if wait < backoff {
+			wait = backoff
+		}
+		// jitter, so that many clients don't come back at once
+		wait += time.Duration(rand.Int63n(int64(wait)/4 + 1))
+		select {
+		case <-time.After(wait):
+		case <-c.closed:
+			return nil
+		}
+		conn, err := c.dial()
+		if err == nil {
+			return conn
+		}
+		log.Println("client: reconnect failed:", err)
+		if backoff *= 2; backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+		wait = backoff
+	}
+}
+
+// restore re-establishes the session after a reconnect.
+func (c *Client) restore() {
+	c.mu.Lock()
+	sid, lastSeq := c.sid, c.lastSeq
+	c.mu.Unlock()
+	if sid == "" {
+		return
+	}
+	if c.Protocol >= 1 {
+		reply, err := c.Request(Message{Name: "session-resume", SID: sid, LastSeq: lastSeq})
+		// the session is busy while hync still considers the previous
+		// connection alive
+		for wait := c.MinBackoff; err == nil && reply.Status == "busy" && wait > 0 && wait <= c.MaxBackoff; wait *= 2 {
+			time.Sleep(wait)
+			reply, err = c.Request(Message{Name: "session-resume", SID: sid, LastSeq: lastSeq})
+		}
+		if err == nil && reply.Status == "ok" {
+			return
+		}
+		log.Println("client: cannot resume session, resyncing:", err, reply.Status)
+	}
+	if err := c.Ehlo(); err != nil {
+		log.Println("client: client-ehlo failed:", err)
+	}
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func assert(t *testing.T, cond bool, msg string, args ...interface{}) bool {
+	if !cond {
+		t.Errorf(msg, args...)
+	}
+	return cond
+}
+
+// fakeHync answers session-create and echoes res-sync. Every message it
+// receives is passed to received; the first connection is dropped after
+// dropAfter messages (0: never).
+type fakeHync struct {
+	received  chan Message
+	dropAfter int
+	conns     int
+}
+
+func (f *fakeHync) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := (&websocket.Upgrader{Subprotocols: []string{"hync.v1"}}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	f.conns++
+	first, n := f.conns == 1, 0
+	for {
+		_, frame, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		msgs := []Message{}
+		json.Unmarshal(frame, &msgs)
+		for _, msg := range msgs {
+			f.received <- msg
+			switch msg.Name {
+			case "session-create":
+				msg.Session = json.RawMessage(`{"sid": "s1", "notes": {}}`)
+				ws.WriteJSON([]Message{msg})
+			case "res-sync":
+				ws.WriteJSON([]Message{msg})
+			}
+			if n++; first && n == f.dropAfter {
+				return
+			}
+		}
+	}
+}
+
+func newTestClient(t *testing.T, f *fakeHync) (*Client, func()) {
+	ts := httptest.NewServer(f)
+	c := New("ws"+strings.TrimPrefix(ts.URL, "http")+"/0/ws", 0)
+	c.MinBackoff, c.MaxBackoff, c.Timeout = 10*time.Millisecond, 50*time.Millisecond, time.Second
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		ts.Close()
+	}
+}
+
+func TestSessionAndSync(t *testing.T) {
+	f := &fakeHync{received: make(chan Message, 16)}
+	c, done := newTestClient(t, f)
+	defer done()
+
+	assert(t, c.Sync("note", "aaaaa", nil) == ErrNoSession, "sync without session should fail")
+	sub := c.Subscribe("res-sync")
+	sess, err := c.CreateSession("anon")
+	if !assert(t, err == nil, "session-create failed: %s", err) {
+		return
+	}
+	assert(t, sess.SID == "s1" && c.SID() == "s1", "unexpected session %#v", sess)
+	assert(t, strings.Contains(string(sess.Raw), "notes"), "raw session state missing")
+	assert(t, (<-f.received).Token == "anon", "token not sent with session-create")
+
+	edits := []Edit{{Clock: Clock{CV: 1}, Delta: Delta(`"=4\t+x"`)}}
+	assert(t, c.Sync("note", "aaaaa", edits) == nil, "sync failed")
+	sent := <-f.received
+	assert(t, sent.Name == "res-sync" && sent.SID == "s1" && sent.Res.ID == "aaaaa", "unexpected res-sync %#v", sent)
+	select {
+	case msg := <-sub.C:
+		assert(t, msg.Changes[0].Clock.CV == 1, "unexpected changes %#v", msg.Changes)
+	case <-time.After(time.Second):
+		t.Error("res-sync not delivered to subscription")
+	}
+}
+
+func TestReconnectSendsEhlo(t *testing.T) {
+	f := &fakeHync{received: make(chan Message, 16), dropAfter: 1}
+	c, done := newTestClient(t, f)
+	defer done()
+
+	_, err := c.CreateSession("anon")
+	assert(t, err == nil, "session-create failed: %s", err)
+	<-f.received
+	select {
+	case msg := <-f.received:
+		assert(t, msg.Name == "client-ehlo" && msg.SID == "s1", "expected client-ehlo after reconnect, got %#v", msg)
+	case <-time.After(2 * time.Second):
+		t.Error("client did not reconnect")
+	}
+}
+
+func TestFullSubscriptionDoesNotBlock(t *testing.T) {
+	f := &fakeHync{received: make(chan Message, 256)}
+	c, done := newTestClient(t, f)
+	defer done()
+
+	_, err := c.CreateSession("anon")
+	assert(t, err == nil, "session-create failed: %s", err)
+	// never drained
+	c.Subscribe("res-sync")
+	for i := 0; i < 100; i++ {
+		c.Sync("note", "aaaaa", nil)
+	}
+	_, err = c.CreateSession("anon")
+	assert(t, err == nil, "session-create after a full subscription failed: %s", err)
+}
+
+func TestConnectTwice(t *testing.T) {
+	f := &fakeHync{received: make(chan Message, 16)}
+	c, done := newTestClient(t, f)
+	defer done()
+	assert(t, c.Connect() == ErrConnected, "second Connect should fail")
+}
+
+func TestProtocolVersion(t *testing.T) {
+	for version, expected := range map[int]string{0: "", 1: "hync.v1", 2: "error"} {
+		ts := httptest.NewServer(&fakeHync{received: make(chan Message, 16)})
+		c := New("ws"+strings.TrimPrefix(ts.URL, "http")+"/0/ws", version)
+		subprotocol := "error"
+		if err := c.Connect(); err == nil {
+			c.mu.Lock()
+			subprotocol = c.conn.Subprotocol()
+			c.mu.Unlock()
+		}
+		c.Close()
+		ts.Close()
+		// the subprotocol takes precedence over the route
+		assert(t, subprotocol == expected, "v%d: expected subprotocol %q, got %q", version, expected, subprotocol)
+	}
+}
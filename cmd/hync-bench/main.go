@@ -0,0 +1,418 @@
+// hync-bench simulates many clients editing notes against a hync instance
+// and reports latencies and error rates as JSON, e.g.
+//
+//	hync-bench -url http://localhost:8888 -admin_url http://localhost:8890 \
+//		-notes n1,n2 -clients 500 -duration 1m > bench.json
+//
+// Every client fetches an anon token from /anontoken, connects to /0/ws,
+// creates a session with the token and then edits the notes of its session
+// (or -notes) with a stream of small text deltas. Clients apply the deltas
+// of the others editing the same notes, so that their own stay valid.
+// Anon sessions start without notes, so -notes must name notes the clients
+// can edit; hync-bench checks that they exist before starting the clients.
+// Clients which give up (e.g. they cannot connect or have nothing to edit)
+// are counted in the report. Drops reported by the server are read from
+// /debug/vars of the listener given with -admin_url, which must serve the
+// metrics handlers.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hiroapp-com/hync/client"
+)
+
+var (
+	baseURL  = flag.String("url", "http://localhost:8888", "base URL of the hync instance")
+	clients  = flag.Int("clients", 100, "number of simulated clients")
+	duration = flag.Duration("duration", 30*time.Second, "how long each client keeps editing")
+	ramp     = flag.Duration("ramp", 10*time.Second, "spread the client connects over this period")
+	interval = flag.Duration("interval", time.Second, "mean time between two edits of a client")
+	notes    = flag.String("notes", "", "comma separated note ids to edit (default: the notes in each client's session)")
+	timeout  = flag.Duration("timeout", 10*time.Second, "max. time to wait for a reply")
+	adminURL = flag.String("admin_url", "", "base URL of a hync listener serving the metrics handlers, to report the server's drops (empty: not reported)")
+)
+
+var words = strings.Fields("the quick brown fox jumps over the lazy dog while hiro syncs every single keystroke")
+
+// latencies collects durations and errors of one kind of operation.
+type latencies struct {
+	mu     sync.Mutex
+	ds     []time.Duration
+	errors int
+}
+
+func (l *latencies) add(d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		l.errors++
+		return
+	}
+	l.ds = append(l.ds, d)
+}
+
+// summary is the JSON representation of latencies.
+type summary struct {
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P99       float64 `json:"p99_ms"`
+	Max       float64 `json:"max_ms"`
+}
+
+func (l *latencies) summary() summary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sort.Slice(l.ds, func(i, j int) bool { return l.ds[i] < l.ds[j] })
+	s := summary{Count: len(l.ds), Errors: l.errors}
+	if total := len(l.ds) + l.errors; total > 0 {
+		s.ErrorRate = float64(l.errors) / float64(total)
+	}
+	if len(l.ds) == 0 {
+		return s
+	}
+	pct := func(p float64) float64 {
+		return ms(l.ds[int(p*float64(len(l.ds)-1))])
+	}
+	s.P50, s.P90, s.P99, s.Max = pct(0.5), pct(0.9), pct(0.99), ms(l.ds[len(l.ds)-1])
+	return s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// report is written to stdout when the run is over.
+type report struct {
+	Clients   int              `json:"clients"`
+	Duration  float64          `json:"duration_s"`
+	Connect   summary          `json:"connect"`
+	Session   summary          `json:"session_create"`
+	Sync      summary          `json:"sync"`
+	SyncRate  float64          `json:"syncs_per_sec"`
+	Failed    int64            `json:"failed_clients"`
+	Server    map[string]int64 `json:"server,omitempty"`
+	StartedAt time.Time        `json:"started_at"`
+}
+
+var connect, session, syncs latencies
+
+// failed counts the clients which gave up.
+var failed int64
+
+// fail records that a client gave up.
+func fail(format string, args ...interface{}) {
+	atomic.AddInt64(&failed, 1)
+	log.Printf("bench: "+format, args...)
+}
+
+// note is a note edited by a simulated client.
+type note struct {
+	id    string
+	len   int
+	clock client.Clock
+}
+
+func main() {
+	flag.Parse()
+	wsURL := "ws" + strings.TrimPrefix(strings.TrimRight(*baseURL, "/"), "http") + "/0/ws"
+	if err := checkNotes(wsURL); err != nil {
+		log.Fatal("bench: ", err)
+	}
+	before := serverStats()
+	started := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			runClient(wsURL)
+		}(time.Duration(rand.Int63n(int64(*ramp) + 1)))
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	rep := report{
+		Clients:   *clients,
+		Duration:  elapsed.Seconds(),
+		Connect:   connect.summary(),
+		Session:   session.summary(),
+		Sync:      syncs.summary(),
+		Failed:    atomic.LoadInt64(&failed),
+		StartedAt: started,
+	}
+	rep.SyncRate = float64(rep.Sync.Count) / elapsed.Seconds()
+	if after := serverStats(); after != nil && before != nil {
+		rep.Server = map[string]int64{}
+		for _, k := range []string{"queue_drops", "queue_timeouts", "queue_disconnects", "ratelimit_throttled", "protocol_errors"} {
+			rep.Server[k] = after[k] - before[k]
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rep); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runClient connects a single client, creates its session and edits notes
+// until -duration is over.
+func runClient(wsURL string) {
+	c, sess, err := newClient(wsURL)
+	if err != nil {
+		fail("client gave up: %s", err)
+		return
+	}
+	defer c.Close()
+	// subscribe before fetching, so that no change is missed
+	changes := c.Subscribe("res-sync")
+	defer changes.Close()
+	edited, err := sessionNotes(c, sess)
+	if err != nil {
+		fail("cannot fetch notes: %s", err)
+		return
+	}
+	if len(edited) == 0 {
+		// the run would not measure any syncs
+		fail("no notes to edit in session %s, give some with -notes", sess.SID)
+		return
+	}
+	byID := map[string]*note{}
+	for _, n := range edited {
+		byID[n.id] = n
+	}
+	deadline := time.Now().Add(*duration)
+	next := time.After(time.Duration(rand.ExpFloat64() * float64(*interval)))
+	for {
+		select {
+		case msg := <-changes.C:
+			// replies to our own edits as well as the edits of other
+			// clients
+			apply(byID, msg)
+			continue
+		case <-next:
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+		next = time.After(time.Duration(rand.ExpFloat64() * float64(*interval)))
+		n := edited[rand.Intn(len(edited))]
+		word := words[rand.Intn(len(words))] + " "
+		start := time.Now()
+		_, err := c.Request(client.Message{
+			Name:    "res-sync",
+			SID:     sess.SID,
+			Res:     &client.Res{Kind: "note", ID: n.id},
+			Changes: []client.Edit{{Clock: n.clock, Delta: textDelta(n.len, rand.Intn(n.len+1), word)}},
+		})
+		syncs.add(time.Since(start), err)
+		if err != nil {
+			continue
+		}
+		n.len += utf8.RuneCountInString(word)
+		n.clock.CV++
+	}
+}
+
+// newClient connects a client and creates a session with an anon token.
+func newClient(wsURL string) (*client.Client, *client.Session, error) {
+	start := time.Now()
+	token, err := anonToken()
+	if err != nil {
+		connect.add(0, err)
+		return nil, nil, fmt.Errorf("cannot get anon token: %s", err)
+	}
+	c := client.New(wsURL, 0)
+	c.Timeout = *timeout
+	err = c.Connect()
+	connect.add(time.Since(start), err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot connect: %s", err)
+	}
+	start = time.Now()
+	sess, err := c.CreateSession(token)
+	session.add(time.Since(start), err)
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("session-create failed: %s", err)
+	}
+	return c, sess, nil
+}
+
+// checkNotes makes sure that the notes given with -notes exist before the
+// clients start editing them.
+func checkNotes(wsURL string) error {
+	if *notes == "" {
+		return nil
+	}
+	c, sess, err := newClient(wsURL)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = sessionNotes(c, sess)
+	return err
+}
+
+// apply applies the changes of a res-sync message to the edited notes. An
+// edit is based on the note's server version: edits already applied are
+// skipped, after a gap the rest is ignored.
+func apply(byID map[string]*note, msg client.Message) {
+	if msg.Res == nil || msg.Res.Kind != "note" || byID[msg.Res.ID] == nil {
+		return
+	}
+	n := byID[msg.Res.ID]
+	for _, e := range msg.Changes {
+		if e.Clock.SV < n.clock.SV {
+			continue
+		}
+		if e.Clock.SV > n.clock.SV {
+			log.Printf("bench: missed changes of note %s (sv %d, got %d)", n.id, n.clock.SV, e.Clock.SV)
+			return
+		}
+		n.len = deltaLen(n.len, e.Delta)
+		n.clock.SV++
+	}
+}
+
+// textDelta inserts word at pos into a text of length n, in
+// diff-match-patch delta notation. Like in diffsync, lengths and positions
+// count runes.
+func textDelta(n, pos int, word string) json.RawMessage {
+	ops := []string{}
+	if pos > 0 {
+		ops = append(ops, fmt.Sprintf("=%d", pos))
+	}
+	ops = append(ops, "+"+word)
+	if n > pos {
+		ops = append(ops, fmt.Sprintf("=%d", n-pos))
+	}
+	delta, _ := json.Marshal(map[string]string{"text": strings.Join(ops, "\t")})
+	return delta
+}
+
+// deltaLen returns the length of a text of length n after applying delta,
+// see textDelta. Inserted text is URI encoded by diff-match-patch.
+func deltaLen(n int, delta json.RawMessage) int {
+	d := map[string]string{}
+	if err := json.Unmarshal(delta, &d); err != nil {
+		return n
+	}
+	l := 0
+	for _, op := range strings.Split(d["text"], "\t") {
+		if op == "" {
+			continue
+		}
+		switch op[0] {
+		case '=':
+			var k int
+			fmt.Sscanf(op[1:], "%d", &k)
+			l += k
+		case '+':
+			text, err := url.PathUnescape(op[1:])
+			if err != nil {
+				text = op[1:]
+			}
+			l += utf8.RuneCountInString(text)
+		}
+	}
+	return l
+}
+
+// sessionNotes returns the notes to edit, i.e. -notes or the notes found
+// in the session state. Notes from -notes the session does not know yet are
+// fetched with an empty res-sync, which fails if they do not exist.
+func sessionNotes(c *client.Client, sess *client.Session) ([]*note, error) {
+	state := struct {
+		Notes map[string]struct {
+			Val struct {
+				Text string `json:"text"`
+			} `json:"val"`
+		} `json:"notes"`
+	}{}
+	json.Unmarshal(sess.Raw, &state)
+	result := []*note{}
+	if *notes != "" {
+		for _, id := range strings.Split(*notes, ",") {
+			n := &note{id: id}
+			if known, ok := state.Notes[id]; ok {
+				n.len = utf8.RuneCountInString(known.Val.Text)
+			} else {
+				reply, err := c.Request(client.Message{Name: "res-sync", SID: sess.SID, Res: &client.Res{Kind: "note", ID: id}})
+				if err != nil {
+					return nil, fmt.Errorf("note %s: %s", id, err)
+				}
+				apply(map[string]*note{id: n}, reply)
+			}
+			result = append(result, n)
+		}
+		return result, nil
+	}
+	for id, n := range state.Notes {
+		result = append(result, &note{id: id, len: utf8.RuneCountInString(n.Val.Text)})
+	}
+	return result, nil
+}
+
+func anonToken() (string, error) {
+	resp, err := http.Get(strings.TrimRight(*baseURL, "/") + "/anontoken")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || len(token) == 0 {
+		return "", fmt.Errorf("GET /anontoken: %s", resp.Status)
+	}
+	return string(token), nil
+}
+
+// serverStats fetches hync's counters from /debug/vars at -admin_url, or
+// nil if they are not available.
+func serverStats() map[string]int64 {
+	if *adminURL == "" {
+		return nil
+	}
+	resp, err := http.Get(strings.TrimRight(*adminURL, "/") + "/debug/vars")
+	if err != nil {
+		log.Println("bench: cannot fetch server stats:", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	vars := struct {
+		Hync map[string]json.RawMessage `json:"hync"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		log.Println("bench: cannot decode server stats:", err)
+		return nil
+	}
+	counters := map[string]int64{}
+	for k, v := range vars.Hync {
+		var n int64
+		if json.Unmarshal(v, &n) == nil {
+			counters[k] = n
+		}
+	}
+	return counters
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+	"github.com/ugorji/go/codec"
+)
+
+// Codec translates between the frames of a wire format and diffsync events.
+// Like diffsync.JsonAdapter, a frame holds a list of messages.
+type Codec interface {
+	Demux(frame []byte) ([][]byte, error)
+	Mux(msgs [][]byte) ([]byte, error)
+	MsgToEvent(msg []byte) (diffsync.Event, error)
+	EventToMsg(event diffsync.Event) ([]byte, error)
+	// FromJSON and ToJSON convert single messages from and to their JSON
+	// representation
+	FromJSON(msg []byte) ([]byte, error)
+	ToJSON(msg []byte) ([]byte, error)
+	// FrameType is the WebSocket message type used for frames
+	FrameType() int
+}
+
+// unversioned subprotocols, see subprotocol()
+const (
+	subprotoJSON    = "hync"
+	subprotoMsgpack = "hync.msgpack"
+)
+
+var codecs = map[string]Codec{
+	"json":    jsonCodec{adapter},
+	"msgpack": msgpackCodec{},
+}
+
+// jsonCodec is the default wire format, i.e. diffsync's JsonAdapter sent as
+// text frames.
+type jsonCodec struct {
+	diffsync.JsonAdapter
+}
+
+func (jsonCodec) FromJSON(msg []byte) ([]byte, error) { return msg, nil }
+func (jsonCodec) ToJSON(msg []byte) ([]byte, error)   { return msg, nil }
+func (jsonCodec) FrameType() int                      { return websocket.TextMessage }
+
+var mh = &codec.MsgpackHandle{RawToString: true, WriteExt: true}
+
+func init() {
+	mh.MapType = reflect.TypeOf(map[string]interface{}(nil))
+}
+
+// msgpackCodec is a binary wire format for clients which prefer MessagePack
+// over JSON. Messages have the same structure as their JSON counterparts and
+// are translated via the JSON adapter, so both codecs yield the same events.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Demux(frame []byte) ([][]byte, error) {
+	list := []interface{}{}
+	if err := codec.NewDecoderBytes(frame, mh).Decode(&list); err != nil {
+		return nil, err
+	}
+	msgs := make([][]byte, len(list))
+	for i := range list {
+		if err := codec.NewEncoderBytes(&msgs[i], mh).Encode(list[i]); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+func (msgpackCodec) Mux(msgs [][]byte) ([]byte, error) {
+	list := make([]interface{}, len(msgs))
+	for i := range msgs {
+		if err := codec.NewDecoderBytes(msgs[i], mh).Decode(&list[i]); err != nil {
+			return nil, err
+		}
+	}
+	frame := []byte{}
+	err := codec.NewEncoderBytes(&frame, mh).Encode(list)
+	return frame, err
+}
+
+func (c msgpackCodec) MsgToEvent(msg []byte) (diffsync.Event, error) {
+	jsonMsg, err := c.ToJSON(msg)
+	if err != nil {
+		return diffsync.Event{}, err
+	}
+	return adapter.MsgToEvent(jsonMsg)
+}
+
+func (c msgpackCodec) EventToMsg(event diffsync.Event) ([]byte, error) {
+	jsonMsg, err := adapter.EventToMsg(event)
+	if err != nil {
+		return nil, err
+	}
+	return c.FromJSON(jsonMsg)
+}
+
+func (msgpackCodec) FromJSON(jsonMsg []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(jsonMsg))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	msg := []byte{}
+	err := codec.NewEncoderBytes(&msg, mh).Encode(fromJSONNumbers(v))
+	return msg, err
+}
+
+func (msgpackCodec) ToJSON(msg []byte) ([]byte, error) {
+	var v interface{}
+	if err := codec.NewDecoderBytes(msg, mh).Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+// fromJSONNumbers replaces all json.Numbers in v by int64 or float64, so
+// that integers (e.g. clocks) stay integers in MessagePack.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = fromJSONNumbers(v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = fromJSONNumbers(v[i])
+		}
+	}
+	return v
+}
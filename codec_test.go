@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// message shapes as sent by html/client.html
+var testMsgs = map[string]string{
+	"res-sync":       `{"name": "res-sync", "sid": "c423b29a406106758074dcc5304bb42e", "tag": "client01", "res": {"kind": "note", "id": "aaaaa"}, "changes": [{"clock": {"cv": 1, "sv": 0}, "delta": {"text": "=11\t+f", "title": "f"}}]}`,
+	"session-create": `{"name": "session-create", "sid": "", "tag": "client01", "token": "anon"}`,
+	"client-ehlo":    `{"name": "client-ehlo", "sid": "c423b29a406106758074dcc5304bb42e", "tag": "client01"}`,
+	"token-consume":  `{"name": "token-consume", "sid": "c423b29a406106758074dcc5304bb42e", "tag": "client01", "token": "4f1a"}`,
+}
+
+// negotiatedCodec returns the codec of a WebSocket client which asks for
+// subprotocol.
+func negotiatedCodec(t *testing.T, subprotocol string) Codec {
+	r, _ := http.NewRequest("GET", "http://localhost/1/ws", nil)
+	if subprotocol != "" {
+		r.Header.Set("Sec-Websocket-Protocol", subprotocol)
+	}
+	proto, codecName, err := negotiateProtocol(r, supportedSubprotocols())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newVersionedCodec(proto, codecName)
+}
+
+func TestNegotiatedCodec(t *testing.T) {
+	assert(t, negotiatedCodec(t, "").FrameType() == websocket.TextMessage, "JSON should be the default codec")
+	assert(t, negotiatedCodec(t, "hync").FrameType() == websocket.TextMessage, "`hync` should select JSON")
+	assert(t, negotiatedCodec(t, "hync.msgpack").FrameType() == websocket.BinaryMessage, "`hync.msgpack` should select MessagePack")
+	assert(t, negotiatedCodec(t, "chat").FrameType() == websocket.TextMessage, "unknown subprotocols should fall back to JSON")
+}
+
+func TestMsgpackSameEvents(t *testing.T) {
+	mp := negotiatedCodec(t, subprotoMsgpack)
+	for name, jsonMsg := range testMsgs {
+		expected, err := adapter.MsgToEvent([]byte(jsonMsg))
+		if err != nil {
+			t.Fatalf("%s: JSON adapter failed: %s", name, err)
+		}
+		msg, err := mp.FromJSON([]byte(jsonMsg))
+		if err != nil {
+			t.Fatalf("%s: cannot convert to msgpack: %s", name, err)
+		}
+		event, err := mp.MsgToEvent(msg)
+		if err != nil {
+			t.Fatalf("%s: msgpack MsgToEvent failed: %s", name, err)
+		}
+		assert(t, reflect.DeepEqual(event, expected), "%s: msgpack event differs from JSON event:\n%#v\n%#v", name, event, expected)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	for _, c := range []Codec{negotiatedCodec(t, subprotoJSON), negotiatedCodec(t, subprotoMsgpack)} {
+		msgs := [][]byte{}
+		events := map[string]interface{}{}
+		for name, jsonMsg := range testMsgs {
+			event, err := adapter.MsgToEvent([]byte(jsonMsg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			events[name] = event
+			msg, err := c.EventToMsg(event)
+			if err != nil {
+				t.Fatalf("%T: EventToMsg(%s) failed: %s", c, name, err)
+			}
+			msgs = append(msgs, msg)
+		}
+		frame, err := c.Mux(msgs)
+		if err != nil {
+			t.Fatalf("%T: Mux failed: %s", c, err)
+		}
+		demuxed, err := c.Demux(frame)
+		if err != nil {
+			t.Fatalf("%T: Demux failed: %s", c, err)
+		}
+		assert(t, len(demuxed) == len(testMsgs), "%T: expected %d messages, got %d", c, len(testMsgs), len(demuxed))
+		for i := range demuxed {
+			event, err := c.MsgToEvent(demuxed[i])
+			if err != nil {
+				t.Fatalf("%T: MsgToEvent failed: %s", c, err)
+			}
+			assert(t, reflect.DeepEqual(event, events[event.Name]), "%T: %s changed in round-trip", c, event.Name)
+		}
+	}
+}
+
+func TestMsgpackKeepsIntegers(t *testing.T) {
+	mp := negotiatedCodec(t, subprotoMsgpack)
+	msg, err := mp.FromJSON([]byte(`{"clock": {"cv": 1, "sv": 0}, "ratio": 0.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonMsg, err := mp.ToJSON(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, string(jsonMsg) == `{"clock":{"cv":1,"sv":0},"ratio":0.5}`, "unexpected JSON after round-trip: %s", jsonMsg)
+}
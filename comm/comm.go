@@ -1,7 +1,10 @@
 package comm
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
@@ -26,9 +29,14 @@ func HandlerGroup(fns ...Handler) Handler {
 		}
 	}(errch)
 	return func(req Request) error {
+		if req.ID == "" {
+			req.ID = NewRequestID()
+		}
 		for i := range fns {
 			go func(fn Handler) {
-				errch <- fn(req)
+				if err := fn(req); err != nil {
+					errch <- fmt.Errorf("[%s] %s", req.ID, err)
+				}
 			}(fns[i])
 		}
 		return nil
@@ -37,7 +45,18 @@ func HandlerGroup(fns ...Handler) Handler {
 
 type RequestTimeoutError struct{}
 
+// NewRequestID returns a random id for a Request.
+func NewRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
 type Request struct {
+	// ID correlates log lines and traces of the request
+	ID   string `json:"id,omitempty"`
 	Kind string `json:"kind"`
 	Rcpt `json:"rcpt"`
 	Data map[string]interface{} `json:"data"`
@@ -51,6 +70,7 @@ type StaticRcpt struct {
 
 func NewRequest(kind string, rcpt Rcpt, data map[string]interface{}) Request {
 	return Request{
+		ID:   NewRequestID(),
 		Kind: kind,
 		Rcpt: rcpt,
 		Data: data,
@@ -74,13 +94,14 @@ func NewStaticRcpt(name, addr, kind string) StaticRcpt {
 
 func NewLogHandler() func(Request) error {
 	return func(req Request) error {
-		log.Println("comm: received request: ", req)
+		log.Printf("comm: [%s] received request: %v", req.ID, req)
 		return nil
 	}
 }
 
 func (req *Request) UnmarshalJSON(src []byte) error {
 	tmp := struct {
+		ID   string     `json:"id"`
 		Kind string     `json:"kind"`
 		Rcpt StaticRcpt `json:"rcpt"`
 		Data map[string]interface{}
@@ -91,6 +112,7 @@ func (req *Request) UnmarshalJSON(src []byte) error {
 	if err := json.Unmarshal(src, &tmp); err != nil {
 		return err
 	}
+	req.ID = tmp.ID
 	req.Kind = tmp.Kind
 	req.Rcpt = tmp.Rcpt
 	req.Data = tmp.Data
@@ -100,6 +122,10 @@ func (req *Request) UnmarshalJSON(src []byte) error {
 type WrapRPC Handler
 
 func (wrapped WrapRPC) Send(req Request, errStr *string) error {
+	if req.ID == "" {
+		req.ID = NewRequestID()
+	}
+	log.Printf("rpc: [%s] received %s request", req.ID, req.Kind)
 	handler := Handler(wrapped)
 	if err := handler(req); err != nil {
 		return err
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 
 	"encoding/json"
 )
@@ -183,7 +182,7 @@ func NewMandrill() func(Request) error {
 		return nil
 	}
 	return func(req Request) error {
-		log.Println("mandrill: received request", req)
+		log.Printf("mandrill: [%s] received request %v", req.ID, req)
 		email, addrKind := req.Rcpt.Addr()
 		if addrKind != "email" {
 			// ignore
@@ -295,16 +294,16 @@ func pingAPI(key string) error {
 	}
 }
 
-func init() {
-	MandrillKey = os.Getenv("MANDRILL_KEY")
+// CheckMandrillKey verifies MandrillKey with the Mandrill API; it does
+// nothing if no key is set.
+func CheckMandrillKey() error {
 	if MandrillKey == "" {
-		return
+		return nil
 	}
 	log.Println("testing mandrill api key...")
-	err := pingAPI(MandrillKey)
-	if err != nil {
-		panic(err)
+	if err := pingAPI(MandrillKey); err != nil {
+		return err
 	}
 	log.Println("mandrill o.k.")
-
+	return nil
 }
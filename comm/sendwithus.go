@@ -8,7 +8,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 )
 
 const SWUSendURL = "https://api.sendwithus.com/api/v1/send"
@@ -54,7 +53,7 @@ func NewSendwithus() func(Request) error {
 			// ignore
 			return nil
 		}
-		log.Println("sendwithus: received request", r)
+		log.Printf("sendwithus: [%s] received request %v", r.ID, r)
 		// send a template
 		tpl := SWUTemplateRequest{EmailID: r.Kind, Data: r.Data}
 		switch r.Kind {
@@ -110,10 +109,3 @@ func NewSendwithus() func(Request) error {
 		return nil
 	}
 }
-
-func init() {
-	SWUApiKey = os.Getenv("SENDWITHUS_KEY")
-	if SWUApiKey == "" {
-		return
-	}
-}
@@ -7,16 +7,18 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 )
 
-const SMSFrom = "+16506207887"
 const TwilioURL = "https://api.twilio.com/2010-04-01/Accounts/%s/SMS/Messages.json"
 
 var (
 	TwilioSID, TwilioToken string
+	// SMSFrom is the sender number of text messages
+	SMSFrom = "+16506207887"
+	// AppURL is the web app the links in text messages point to
+	AppURL = "https://beta.hiroapp.com"
 )
 
 type TwilioError struct {
@@ -64,7 +66,7 @@ func NewTwilio() Handler {
 			// ignore
 			return nil
 		}
-		log.Println("twilio: received request", req)
+		log.Printf("twilio: [%s] received request %v", req.ID, req)
 		var inviterName, inviterPhone, inviterEmail string
 		if s, ok := req.Data["inviter_name"].(string); ok {
 			inviterName = s
@@ -83,15 +85,22 @@ func NewTwilio() Handler {
 				from = from[:25]
 			}
 			peek := firstNonEmpty(req.Data["title"].(string), req.Data["peek"].(string), "New Note")
-			remaining := 160 - len(from) - 32 - 56 // update last number when changin the share-text
+			// 32: token, 32: share-text without the app URL (update when
+			// changing the share-text)
+			remaining := 160 - len(from) - 32 - 32 - len(AppURL)
+			if remaining < 3 {
+				// long -app_url, the message takes more than one SMS
+				// anyway
+				remaining = 3
+			}
 			if len(peek) > remaining {
 				peek = peek[:remaining-3] + "..."
 			}
-			body = fmt.Sprintf("%s shared the note '%s' with you: https://beta.hiroapp.com/#%s", from, peek, req.Data["token"].(string))
+			body = fmt.Sprintf("%s shared the note '%s' with you: %s/#%s", from, peek, AppURL, req.Data["token"].(string))
 		case "verify":
-			body = fmt.Sprintf("Please verify your device by visiting https://beta.hiroapp.com/#v:%s", req.Data["token"].(string))
+			body = fmt.Sprintf("Please verify your device by visiting %s/#v:%s", AppURL, req.Data["token"].(string))
 		case "reset-pwd":
-			body = fmt.Sprintf("You can now reset your password at https://beta.hiroapp.com/#r:%s", req.Data["token"].(string))
+			body = fmt.Sprintf("You can now reset your password at %s/#r:%s", AppURL, req.Data["token"].(string))
 		default:
 		}
 		if body == "" {
@@ -109,8 +118,3 @@ func firstNonEmpty(args ...string) string {
 	}
 	return ""
 }
-
-func init() {
-	TwilioSID = os.Getenv("TWILIO_SID")
-	TwilioToken = os.Getenv("TWILIO_TOKEN")
-}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hiroapp-com/hync/comm"
+)
+
+// hync's settings are its flags. Every setting can also be given in the
+// JSON file passed with -config and in the environment; the precedence is
+//
+//	command line > environment > config file > default
+//
+// In the config file, the keys are the flag names. Settings can be grouped
+// in objects, whose keys are joined with "_":
+//
+//	{
+//	  "listen": ["unix:///run/hync/hync.sock?mode=0660"],
+//	  "db_host": "postgres://hiro@db/hiro",
+//	  "tls": {"cert": "/etc/hync/cert.pem", "key": "/etc/hync/key.pem"},
+//	  "ping_interval": "30s",
+//	  "queue_size": 16
+//	}
+//
+// In the environment, a setting is HYNC_ plus its upper-cased name, e.g.
+// HYNC_DB_HOST. Secrets can be read from a file instead, using the setting
+// name plus _file (config file) or _FILE (environment). hync warns about
+// secrets on the command line.
+
+// secretSettings are masked by `hync config check`, can be read from a
+// file and should not be given on the command line.
+var secretSettings = map[string]bool{
+	"db_host":        true,
+	"auth_secret":    true,
+	"sendwithus_key": true,
+	"mandrill_key":   true,
+	"twilio_token":   true,
+}
+
+// legacyEnv maps settings to the environment variables they were read from
+// before there was a config file; the HYNC_ names take precedence.
+var legacyEnv = map[string]string{
+	"sendwithus_key": "SENDWITHUS_KEY",
+	"mandrill_key":   "MANDRILL_KEY",
+	"twilio_sid":     "TWILIO_SID",
+	"twilio_token":   "TWILIO_TOKEN",
+}
+
+// settingSources records where each setting which isn't the default came
+// from.
+var settingSources = map[string]string{}
+
+// resetter is implemented by flags which can be given multiple times, like
+// -listen. They are reset when a source with higher precedence sets them.
+type resetter interface {
+	reset()
+}
+
+// loadConfig applies the config file and the environment to all settings
+// not given on the command line.
+func loadConfig(fs *flag.FlagSet, path string, environ []string) error {
+	fs.Visit(func(f *flag.Flag) {
+		settingSources[f.Name] = "flag"
+		if secretSettings[f.Name] && containsSecret(f.Name, f.Value.String()) {
+			// everyone on the host can read the command line (ps,
+			// /proc/<pid>/cmdline)
+			log.Printf("config: -%s is given on the command line, where every user on the host can read it; use HYNC_%s(_FILE) or the config file", f.Name, strings.ToUpper(f.Name))
+		}
+	})
+	if path != "" {
+		settings, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := settings[name+"_file"]; ok {
+				return fmt.Errorf("config %s: both %s and %s_file given", path, name, name)
+			}
+			if err := applyConfigValue(fs, name, settings[name]); err != nil {
+				return fmt.Errorf("config %s: %s", path, err)
+			}
+		}
+	}
+	env := map[string]string{}
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || settingSources[f.Name] == "flag" || f.Name == "config" {
+			return
+		}
+		err = applyEnv(f, env)
+	})
+	return err
+}
+
+// readConfigFile reads the config file and flattens its groups.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("config %s: %s", path, err)
+	}
+	settings := map[string]interface{}{}
+	flattenConfig("", raw, settings)
+	return settings, nil
+}
+
+func flattenConfig(prefix string, raw map[string]interface{}, settings map[string]interface{}) {
+	for key, v := range raw {
+		if group, ok := v.(map[string]interface{}); ok {
+			flattenConfig(prefix+key+"_", group, settings)
+			continue
+		}
+		settings[prefix+key] = v
+	}
+}
+
+// applyConfigValue sets the flag name to the config file value v, unless
+// it was given on the command line.
+func applyConfigValue(fs *flag.FlagSet, name string, v interface{}) error {
+	if strings.HasSuffix(name, "_file") && secretSettings[strings.TrimSuffix(name, "_file")] {
+		path, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", name)
+		}
+		secret, err := readSecret(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		name, v = strings.TrimSuffix(name, "_file"), secret
+	}
+	f := fs.Lookup(name)
+	if f == nil || name == "config" {
+		return fmt.Errorf("unknown setting `%s`", name)
+	}
+	if settingSources[name] == "flag" {
+		return nil
+	}
+	values, err := configStrings(f, v)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return setFlag(f, "config", values)
+}
+
+// configStrings checks the type of a config file value against the flag
+// and returns its string representation(s) for flag.Value.Set.
+func configStrings(f *flag.Flag, v interface{}) ([]string, error) {
+	if list, ok := v.([]interface{}); ok {
+		if _, repeatable := f.Value.(resetter); !repeatable {
+			return nil, fmt.Errorf("must not be a list")
+		}
+		values := []string{}
+		for i := range list {
+			s, ok := list[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("list must only hold strings")
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		return []string{s}, nil
+	}
+	switch getter.Get().(type) {
+	case bool:
+		if b, ok := v.(bool); ok {
+			return []string{fmt.Sprint(b)}, nil
+		}
+		return nil, fmt.Errorf("must be true or false")
+	case int, int64, uint, uint64, float64:
+		if n, ok := v.(float64); ok {
+			return []string{strconv.FormatFloat(n, 'f', -1, 64)}, nil
+		}
+		return nil, fmt.Errorf("must be a number")
+	case time.Duration:
+		if s, ok := v.(string); ok {
+			return []string{s}, nil
+		}
+		return nil, fmt.Errorf("must be a duration like \"1m30s\"")
+	}
+	if s, ok := v.(string); ok {
+		return []string{s}, nil
+	}
+	return nil, fmt.Errorf("must be a string")
+}
+
+// applyEnv sets f from HYNC_<NAME>, HYNC_<NAME>_FILE (secrets) or its legacy
+// environment variable, in this order.
+func applyEnv(f *flag.Flag, env map[string]string) error {
+	key := "HYNC_" + strings.ToUpper(f.Name)
+	if v, ok := env[key]; ok {
+		if _, repeatable := f.Value.(resetter); repeatable {
+			// e.g. HYNC_LISTEN="0.0.0.0:8888 unix:///run/hync.sock"
+			return setFlag(f, "env", strings.Fields(v))
+		}
+		return setFlag(f, "env", []string{v})
+	}
+	if secretSettings[f.Name] {
+		if path, ok := env[key+"_FILE"]; ok {
+			secret, err := readSecret(path)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %s", key, err)
+			}
+			return setFlag(f, "env", []string{secret})
+		}
+	}
+	if legacy, ok := legacyEnv[f.Name]; ok {
+		if v, ok := env[legacy]; ok {
+			return setFlag(f, "env", []string{v})
+		}
+	}
+	return nil
+}
+
+// setFlag sets f to values; repeatable flags are reset first.
+func setFlag(f *flag.Flag, source string, values []string) error {
+	if r, ok := f.Value.(resetter); ok {
+		r.reset()
+	}
+	for _, v := range values {
+		if err := f.Value.Set(v); err != nil {
+			return fmt.Errorf("invalid value `%s` for %s from %s: %s", v, f.Name, source, err)
+		}
+	}
+	settingSources[f.Name] = source
+	return nil
+}
+
+// readSecret reads a secret from a file, without trailing newlines.
+func readSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+var phoneNumber = regexp.MustCompile(`^\+[0-9]{6,15}$`)
+
+// checkConfig validates the settings. It does not open or create any
+// files except reading the TLS certificates.
+func checkConfig() error {
+	if err := checkQueuePolicy(*queuePolicy); err != nil {
+		return err
+	}
+	if err := setupRateLimits(); err != nil {
+		return err
+	}
+	if err := setupProtocols(); err != nil {
+		return err
+	}
+	if *wsMaxMissedPongs < 1 || *pingInterval <= 0 {
+		return fmt.Errorf("-ws_max_missed_pongs must be at least 1 and -ping_interval positive")
+	}
+	if *resumeBuffer < 1 {
+		return fmt.Errorf("-resume_buffer must be at least 1")
+	}
+	if *captureSample < 0 || *captureSample > 1 {
+		return fmt.Errorf("-capture_sample must be between 0 and 1")
+	}
+	if *maxConns < 0 || *maxConnsPerIP < 0 || *idleTimeout < 0 || *maxConnLifetime < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if _, err := NewAuthenticator(nil, *authMode, nil, *authCookie, nil); err != nil {
+		return err
+	}
+	if *authMode != authOff && *authSecret == "" {
+		log.Println("config: -auth_secret is empty, signed auth cookies are not accepted")
+	}
+	if _, ok := tlsVersions[*tlsMinVersion]; !ok {
+		return fmt.Errorf("invalid -tls_min_version `%s`, must be one of 1.0, 1.1, 1.2, 1.3", *tlsMinVersion)
+	}
+	for _, pair := range [][2]string{{*tlsCert, *tlsKey}, {*commTLSCert, *commTLSKey}} {
+		if pair[0] == "" && pair[1] == "" {
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(pair[0], pair[1]); err != nil {
+			return fmt.Errorf("TLS certificate %s: %s", pair[0], err)
+		}
+	}
+	if len(listeners.specs) == 0 {
+		return fmt.Errorf("no -listen given")
+	}
+	if *dbHost == "" {
+		return fmt.Errorf("-db_host must be set")
+	}
+	if (*twilioSID == "") != (*twilioToken == "") {
+		return fmt.Errorf("-twilio_sid and -twilio_token must be set together")
+	}
+	if !phoneNumber.MatchString(*smsFrom) {
+		return fmt.Errorf("invalid -sms_from `%s`, must be a phone number like +16505550100", *smsFrom)
+	}
+	if u, err := url.Parse(*appURL); err != nil || u.Scheme == "" || u.Host == "" || strings.HasSuffix(*appURL, "/") {
+		return fmt.Errorf("invalid -app_url `%s`, must be an absolute URL without trailing slash", *appURL)
+	}
+	return nil
+}
+
+// configureComm passes the comm settings to the comm package.
+func configureComm() {
+	comm.SWUApiKey = *sendwithusKey
+	comm.MandrillKey = *mandrillKey
+	comm.TwilioSID, comm.TwilioToken = *twilioSID, *twilioToken
+	comm.SMSFrom, comm.AppURL = *smsFrom, *appURL
+}
+
+// maskSecret hides a secret; passwords in URLs (e.g. -db_host) are masked,
+// the rest of the URL is kept.
+func maskSecret(v string) string {
+	if v == "" {
+		return ""
+	}
+	if u, err := url.Parse(v); err == nil && u.User != nil && u.Host != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		return u.String()
+	}
+	return "*****"
+}
+
+// containsSecret reports whether the value of the secret setting name holds
+// anything secret; -db_host only does if it includes a password, either as
+// URL or as keyword/value connection string (host=db password=...).
+func containsSecret(name, v string) bool {
+	if name != "db_host" {
+		return v != ""
+	}
+	if u, err := url.Parse(v); err == nil && u.Host != "" {
+		if u.User == nil {
+			return false
+		}
+		_, ok := u.User.Password()
+		return ok
+	}
+	return strings.Contains(v, "password=")
+}
+
+// printConfig writes the effective settings with their source, secrets
+// masked.
+func printConfig(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretSettings[f.Name] {
+			v = maskSecret(v)
+		}
+		source := settingSources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%-24s %-50s # %s\n", f.Name, v, source)
+	})
+}
+
+// configCommand implements `hync config check [flags]`.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: hync config check [flags]")
+		return 2
+	}
+	if err := flag.CommandLine.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if err := loadConfig(flag.CommandLine, *configFile, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printConfig(os.Stdout, flag.CommandLine)
+	if err := checkConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "config ok")
+	return 0
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags returns a flag set with a few settings like hync's.
+func testFlags() (*flag.FlagSet, *string, *int, *time.Duration, *string, *listenFlag) {
+	settingSources = map[string]string{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	host := fs.String("db_host", "postgres://localhost/hiro", "")
+	size := fs.Int("queue_size", 16, "")
+	interval := fs.Duration("ping_interval", 30*time.Second, "")
+	secret := fs.String("auth_secret", "", "")
+	lf := &listenFlag{specs: []listenerSpec{{Network: "tcp", Addr: "0.0.0.0:8888", Handlers: []string{handlersPublic}}}}
+	fs.Var(lf, "listen", "")
+	return fs, host, size, interval, secret, lf
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := writeFile(t, dir, "secret", "s3cret\n")
+	path := writeFile(t, dir, "hync.json", `{
+		"db_host": "postgres://hiro:pw@db/hiro",
+		"queue": {"size": 32},
+		"ping_interval": "10s",
+		"auth_secret_file": "`+secretFile+`",
+		"listen": ["unix:///run/hync.sock?mode=0660", "127.0.0.1:8080"]
+	}`)
+
+	fs, host, size, interval, secret, lf := testFlags()
+	fs.Parse([]string{"-queue_size", "64"})
+	err = loadConfig(fs, path, []string{"HYNC_PING_INTERVAL=5s", "OTHER=1"})
+	assert(t, err == nil, "loading config failed: %v", err)
+	assert(t, *host == "postgres://hiro:pw@db/hiro", "config file not applied: %s", *host)
+	assert(t, *size == 64, "command line should override config file: %d", *size)
+	assert(t, *interval == 5*time.Second, "env should override config file: %s", *interval)
+	assert(t, *secret == "s3cret", "secret not read from file: %q", *secret)
+	assert(t, lf.String() == "unix:///run/hync.sock?mode=0660 tcp://127.0.0.1:8080", "unexpected listeners %s", lf)
+
+	buf := &bytes.Buffer{}
+	printConfig(buf, fs)
+	out := buf.String()
+	assert(t, !strings.Contains(out, "s3cret") && !strings.Contains(out, ":pw@"), "secret not masked:\n%s", out)
+	assert(t, strings.Contains(out, "postgres://hiro:xxxxx@db/hiro"), "db_host should only have its password masked:\n%s", out)
+	assert(t, strings.Contains(out, "# flag") && strings.Contains(out, "# env") && strings.Contains(out, "# config"), "sources missing:\n%s", out)
+}
+
+func TestSecretFlags(t *testing.T) {
+	for v, secret := range map[string]bool{
+		"postgres://hiro:pw@db/hiro":          true,
+		"postgres://hiro@db/hiro":             false,
+		"host=db dbname=hiro user=hiro":       false,
+		"host=db dbname=hiro password=pw":     true,
+		"postgres:///hiro?host=/run/postgres": false,
+	} {
+		assert(t, containsSecret("db_host", v) == secret, "%s: expected containsSecret %v", v, secret)
+	}
+	assert(t, containsSecret("auth_secret", "host=a=b"), "other secrets are secret whatever their form")
+
+	// secrets on the command line are only warned about
+	fs, _, _, _, secret, _ := testFlags()
+	fs.Parse([]string{"-auth_secret", "s3cret"})
+	err := loadConfig(fs, "", nil)
+	assert(t, err == nil && *secret == "s3cret", "secret on the command line should be accepted: %v", err)
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for content, want := range map[string]string{
+		`{"db_hots": "x"}`:                  "unknown setting `db_hots`",
+		`{"queue_size": "32"}`:              "queue_size: must be a number",
+		`{"queue_size": 1.5}`:               "invalid value `1.5` for queue_size",
+		`{"ping_interval": 30}`:             "ping_interval: must be a duration",
+		`{"db_host": ["a"]}`:                "db_host: must not be a list",
+		`{"listen": ["udp://:53"]}`:         "unknown network `udp`",
+		`{"auth_secret_file": "/nonexist"}`: "auth_secret_file:",
+		`{"queue_size": 1`:                  "unexpected end of JSON input",
+	} {
+		fs, _, _, _, _, _ := testFlags()
+		err := loadConfig(fs, writeFile(t, dir, "hync.json", content), nil)
+		assert(t, err != nil && strings.Contains(err.Error(), want), "%s: expected error %q, got %v", content, want, err)
+	}
+}
+
+func TestEnvSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, _, _, _, secret, lf := testFlags()
+	err = loadConfig(fs, "", []string{"HYNC_AUTH_SECRET_FILE=" + writeFile(t, dir, "secret", "fromfile"), "HYNC_LISTEN=a.sock:1 unix://b.sock"})
+	assert(t, err == nil && *secret == "fromfile", "secret not read from file: %q, %v", *secret, err)
+	assert(t, len(lf.specs) == 2 && lf.specs[1].Network == "unix", "listeners not replaced: %s", lf)
+}
+
+func TestCheckConfig(t *testing.T) {
+	assert(t, checkConfig() == nil, "defaults should be valid: %v", checkConfig())
+	defer func(url string) { *appURL = url }(*appURL)
+	*appURL = "beta.hiroapp.com/"
+	err := checkConfig()
+	assert(t, err != nil && strings.Contains(err.Error(), "-app_url"), "invalid app url accepted: %v", err)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errTooManyConns   = errors.New("too many connections")
+	errTooManyConnsIP = errors.New("too many connections from this address")
+)
+
+// connCaps enforces -max_conns and -max_conns_per_ip.
+type connCaps struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var caps = newConnCaps()
+
+func newConnCaps() *connCaps {
+	return &connCaps{perIP: map[string]int{}}
+}
+
+// acquire reserves a connection slot for ip; it must be released once the
+// connection is closed.
+func (cc *connCaps) acquire(ip string, max, maxPerIP int) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if max > 0 && cc.total >= max {
+		count("conns_rejected_total")
+		return errTooManyConns
+	}
+	if maxPerIP > 0 && cc.perIP[ip] >= maxPerIP {
+		count("conns_rejected_ip")
+		return errTooManyConnsIP
+	}
+	cc.total++
+	cc.perIP[ip]++
+	return nil
+}
+
+func (cc *connCaps) release(ip string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.total--
+	if cc.perIP[ip]--; cc.perIP[ip] <= 0 {
+		delete(cc.perIP, ip)
+	}
+}
+
+// acquireConn reserves a slot for a new connection from ip.
+func acquireConn(ip string) error {
+	return caps.acquire(ip, *maxConns, *maxConnsPerIP)
+}
+
+// rejectBusy answers handshakes which exceed the connection caps.
+func rejectBusy(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter()/time.Second)+1))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// lifetime returns the max. lifetime of a new connection. -max_conn_lifetime
+// is extended by up to 10%, so that connections opened at the same time
+// (e.g. after a restart) don't all reconnect at once.
+func lifetime() time.Duration {
+	if *maxConnLifetime <= 0 {
+		return 0
+	}
+	return *maxConnLifetime + time.Duration(rand.Int63n(int64(*maxConnLifetime)/10+1))
+}
+
+// expiry tells why a connection is closed by expired.
+type expiry struct {
+	Code   int
+	Reason string
+	// Reconnect is set if the client is asked to reconnect after Retry
+	Reconnect bool
+	Retry     time.Duration
+}
+
+// expired checks whether the connection has been idle longer than
+// -idle_timeout or reached its max. lifetime; it returns nil if the
+// connection may stay open. Clients asked to reconnect get a "retry after"
+// hint like on shutdown.
+func (c *connInfo) expired(now time.Time) *expiry {
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+	if *idleTimeout > 0 && idle > *idleTimeout {
+		count("conns_idle_closed")
+		return &expiry{Code: websocket.CloseGoingAway, Reason: "idle timeout"}
+	}
+	if c.maxLifetime > 0 && now.Sub(c.ConnectedAt) > c.maxLifetime {
+		count("conns_lifetime_closed")
+		retry := time.Duration(rand.Int63n(int64(*restartRetry) + 1))
+		return &expiry{
+			Code:      websocket.CloseServiceRestart,
+			Reason:    fmt.Sprintf("max-lifetime reached, retry after %d ms", retry/time.Millisecond),
+			Reconnect: true,
+			Retry:     retry,
+		}
+	}
+	return nil
+}
+
+// checkExpired logs and returns the result of c.expired.
+func checkExpired(c *connInfo) *expiry {
+	exp := c.expired(time.Now())
+	if exp != nil {
+		log.Printf("%s: closing connection %s: %s", c.Transport, c.ID, exp.Reason)
+	}
+	return exp
+}
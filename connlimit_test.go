@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnCaps(t *testing.T) {
+	cc := newConnCaps()
+	assert(t, cc.acquire("1.1.1.1", 3, 2) == nil, "first connection rejected")
+	assert(t, cc.acquire("1.1.1.1", 3, 2) == nil, "second connection rejected")
+	assert(t, cc.acquire("1.1.1.1", 3, 2) == errTooManyConnsIP, "per-IP cap not enforced")
+	assert(t, cc.acquire("2.2.2.2", 3, 2) == nil, "other IP rejected")
+	assert(t, cc.acquire("3.3.3.3", 3, 2) == errTooManyConns, "global cap not enforced")
+	cc.release("1.1.1.1")
+	assert(t, cc.acquire("3.3.3.3", 3, 2) == nil, "released slot not reusable")
+	cc.release("2.2.2.2")
+	_, ok := cc.perIP["2.2.2.2"]
+	assert(t, !ok, "IPs without connections should be forgotten")
+}
+
+func TestExpired(t *testing.T) {
+	defer func(idle, max time.Duration) { *idleTimeout, *maxConnLifetime = idle, max }(*idleTimeout, *maxConnLifetime)
+	*idleTimeout, *maxConnLifetime = time.Minute, time.Hour
+	c := newConnInfo("ws", "127.0.0.1:1", "test")
+	now := time.Now()
+	assert(t, c.expired(now) == nil, "new connection expired")
+
+	exp := c.expired(now.Add(2 * time.Minute))
+	assert(t, exp != nil && exp.Code == websocket.CloseGoingAway && !exp.Reconnect, "idle connection not closed: %v", exp)
+
+	c.received("", 1)
+	assert(t, c.expired(now.Add(30*time.Second)) == nil, "events should reset the idle timeout")
+
+	*idleTimeout = 0
+	assert(t, c.maxLifetime >= time.Hour && c.maxLifetime <= time.Hour+6*time.Minute, "unexpected lifetime %s", c.maxLifetime)
+	exp = c.expired(now.Add(2 * time.Hour))
+	assert(t, exp != nil && exp.Code == websocket.CloseServiceRestart && exp.Reconnect, "old connection not asked to reconnect: %v", exp)
+	assert(t, strings.Contains(exp.Reason, "retry after "), "reason has no retry hint: %s", exp.Reason)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// countingConn counts the bytes which actually go over the wire, i.e. after
+// compression and including framing.
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+func (c *countingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// countingHijacker wraps the http.ResponseWriter passed to the websocket
+// Upgrader, so that the hijacked connection is a countingConn.
+type countingHijacker struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if brw.Reader.Buffered() > 0 {
+		// hand out the original reader, the upgrader will bail out anyway
+		return conn, brw, nil
+	}
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
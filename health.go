@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// health tracks the state reported by /healthz and /readyz, which are
+// served on every listener. The checks of /readyz include error messages of
+// the database driver and the comm providers, so their breakdown is only
+// served on listeners serving the admin or metrics handlers.
+//
+//	GET /healthz   liveness: 200 as long as hync serves HTTP
+//	GET /readyz    readiness: 200 if hync can serve clients, 503 otherwise,
+//	               with a JSON breakdown of the checks on internal listeners
+type health struct {
+	mu          sync.Mutex
+	db          *sql.DB
+	srvRunning  bool
+	commRPCUp   bool
+	draining    bool
+	providers   map[string]providerStatus
+	startedAt   time.Time
+	dbPingLimit time.Duration
+}
+
+// providerStatus is the outcome of the last request handled by a comm
+// provider.
+type providerStatus struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+var healthState = &health{providers: map[string]providerStatus{}, startedAt: time.Now()}
+
+func (h *health) setDB(db *sql.DB, timeout time.Duration) {
+	h.mu.Lock()
+	h.db, h.dbPingLimit = db, timeout
+	h.mu.Unlock()
+}
+
+func (h *health) setSrvRunning(running bool) {
+	h.mu.Lock()
+	h.srvRunning = running
+	h.mu.Unlock()
+}
+
+func (h *health) setCommRPCUp(up bool) {
+	h.mu.Lock()
+	h.commRPCUp = up
+	h.mu.Unlock()
+}
+
+// drain makes readiness fail, so that no new clients are sent our way
+// while shutting down.
+func (h *health) drain() {
+	h.mu.Lock()
+	h.draining = true
+	h.mu.Unlock()
+}
+
+// recordProvider records the outcome of a comm provider's request.
+func (h *health) recordProvider(provider string, err error) {
+	st := providerStatus{Status: "ok", At: time.Now()}
+	if err != nil {
+		st.Status, st.Error = "error", err.Error()
+	}
+	h.mu.Lock()
+	h.providers[provider] = st
+	h.mu.Unlock()
+}
+
+// check is the result of a readiness check.
+type check struct {
+	Status    string                    `json:"status"`
+	Error     string                    `json:"error,omitempty"`
+	LatencyMS float64                   `json:"latency_ms,omitempty"`
+	Providers map[string]providerStatus `json:"providers,omitempty"`
+}
+
+func passed(ok bool, reason string) check {
+	if ok {
+		return check{Status: "ok"}
+	}
+	return check{Status: "fail", Error: reason}
+}
+
+// readiness runs all checks. Failed comm providers do not make hync
+// unready: all instances share the providers, so taking them out of
+// rotation would not help anyone.
+func (h *health) readiness(ctx context.Context) (bool, map[string]check) {
+	h.mu.Lock()
+	db, timeout := h.db, h.dbPingLimit
+	checks := map[string]check{
+		"srv":      passed(h.srvRunning, "sync server not running"),
+		"comm_rpc": passed(h.commRPCUp, "comm RPC listener not up"),
+		"draining": passed(!h.draining, "shutting down"),
+	}
+	providers := check{Status: "ok", Providers: map[string]providerStatus{}}
+	for name, st := range h.providers {
+		providers.Providers[name] = st
+		if st.Status != "ok" {
+			providers.Status = "degraded"
+		}
+	}
+	checks["comm_providers"] = providers
+	h.mu.Unlock()
+
+	if db == nil {
+		checks["db"] = passed(false, "no database")
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		if err := db.PingContext(ctx); err != nil {
+			checks["db"] = passed(false, err.Error())
+		} else {
+			checks["db"] = check{Status: "ok", LatencyMS: float64(time.Since(start)) / float64(time.Millisecond)}
+		}
+		cancel()
+	}
+	ready := true
+	for _, c := range checks {
+		if c.Status == "fail" {
+			ready = false
+		}
+	}
+	return ready, checks
+}
+
+func (h *health) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "ok",
+		"version":    HYNC_VERSION,
+		"uptime_sec": int64(time.Since(h.startedAt) / time.Second),
+	})
+}
+
+func (h *health) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	h.serveReadiness(w, r, true)
+}
+
+// publicReadyzHandler serves /readyz on public listeners: the status only,
+// without the checks.
+func (h *health) publicReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	h.serveReadiness(w, r, false)
+}
+
+func (h *health) serveReadiness(w http.ResponseWriter, r *http.Request, breakdown bool) {
+	ready, checks := h.readiness(r.Context())
+	if !ready {
+		count("readyz_failed")
+	}
+	if !breakdown {
+		if ready {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+		} else {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "fail"})
+		}
+		return
+	}
+	if ready {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+		return
+	}
+	failed := []string{}
+	for name, c := range checks {
+		if c.Status == "fail" {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "fail", "failed": failed, "checks": checks})
+}
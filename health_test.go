@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func readyz(h *health) (int, map[string]interface{}) {
+	rec := httptest.NewRecorder()
+	h.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	body := map[string]interface{}{}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec.Code, body
+}
+
+func TestReadiness(t *testing.T) {
+	h := &health{providers: map[string]providerStatus{}}
+	code, body := readyz(h)
+	assert(t, code == http.StatusServiceUnavailable, "hync should not be ready on startup")
+	failed, _ := body["failed"].([]interface{})
+	assert(t, len(failed) == 3, "expected db, srv and comm_rpc to fail: %v", body["failed"])
+
+	h.setSrvRunning(true)
+	h.setCommRPCUp(true)
+	h.recordProvider("twilio", errors.New("down"))
+	ready, checks := h.readiness(context.Background())
+	assert(t, !ready && checks["db"].Status == "fail", "db check should fail without database: %v", checks["db"])
+	assert(t, checks["srv"].Status == "ok" && checks["comm_rpc"].Status == "ok", "unexpected checks %v", checks)
+	providers := checks["comm_providers"]
+	assert(t, providers.Status == "degraded" && providers.Providers["twilio"].Error == "down", "provider status not reported: %v", providers)
+
+	h.drain()
+	_, checks = h.readiness(context.Background())
+	assert(t, checks["draining"].Status == "fail", "readiness should fail while draining")
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	listenerMux(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert(t, rec.Code == http.StatusOK, "healthz should be served on every listener: %d", rec.Code)
+
+	for handlers, breakdown := range map[string]bool{handlersPublic: false, handlersAdmin: true, handlersMetrics: true} {
+		rec := httptest.NewRecorder()
+		listenerMux([]string{handlers}).ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		assert(t, rec.Code == http.StatusServiceUnavailable, "/readyz on %s listener: got %d, expected %d", handlers, rec.Code, http.StatusServiceUnavailable)
+		body := map[string]interface{}{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		_, ok := body["checks"]
+		assert(t, body["status"] == "fail" && ok == breakdown, "/readyz on %s listener: breakdown %v expected, got %s", handlers, breakdown, rec.Body)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	rttHistogram  = newHistogram("ws_rtt_ms", 5, 10, 25, 50, 100, 250, 500, 1000, 2500)
+	errMissedPong = errors.New("peer missed too many pongs")
+)
+
+// pongWait is how long we wait for any pong before considering the peer
+// dead, i.e. -ws_max_missed_pongs ping intervals plus some slack.
+func pongWait() time.Duration {
+	return time.Duration(*wsMaxMissedPongs)*(*pingInterval) + *pingInterval/2
+}
+
+// setupKeepalive limits the size of incoming messages and installs a pong
+// handler which extends the read deadline and measures the round-trip time.
+// Reads on a connection whose peer stops answering our pings time out.
+func (c *wsConn) setupKeepalive() {
+	c.SetReadLimit(*wsMaxMessage)
+	c.SetReadDeadline(time.Now().Add(pongWait()))
+	c.SetPongHandler(func(data string) error {
+		atomic.AddInt64(&c.pongs, 1)
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			rtt := time.Since(time.Unix(0, sent))
+			atomic.StoreInt64(&c.info.rtt, int64(rtt))
+			rttHistogram.Observe(float64(rtt) / float64(time.Millisecond))
+		}
+		return c.SetReadDeadline(time.Now().Add(pongWait()))
+	})
+}
+
+// ping sends a ping carrying the current time, which is echoed in the pong.
+// It fails if the peer did not answer the last -ws_max_missed_pongs pings.
+func (c *wsConn) ping() error {
+	if c.pings-atomic.LoadInt64(&c.pongs) >= int64(*wsMaxMissedPongs) {
+		count("ws_dead_peers")
+		return errMissedPong
+	}
+	c.pings++
+	data := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	return c.WriteControl(websocket.PingMessage, data, time.Now().Add(*writeTimeout))
+}
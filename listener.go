@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Handler sets which can be mounted on a listener.
+const (
+	handlersPublic  = "public"  // sync endpoints, /anontoken and /client
+	handlersAdmin   = "admin"   // /admin/ (see NewAdminMux) and the /readyz breakdown
+	handlersMetrics = "metrics" // /metrics, /debug/vars and the /readyz breakdown
+)
+
+// listenerSpec describes a listener given with -listen:
+//
+//	0.0.0.0:8888                                       tcp, public handlers
+//	tcp://127.0.0.1:8889?handlers=admin,metrics
+//	tcp6://[::1]:8888
+//	unix:///run/hync/hync.sock?mode=0660&owner=hync:www-data
+//
+// handlers defaults to public. mode and owner (user[:group]) only apply to
+// unix sockets.
+type listenerSpec struct {
+	Network  string
+	Addr     string
+	Handlers []string
+	Mode     os.FileMode
+	Owner    string
+}
+
+func (ls listenerSpec) String() string {
+	return fmt.Sprintf("%s://%s (%s)", ls.Network, ls.Addr, strings.Join(ls.Handlers, ","))
+}
+
+// URL returns ls in the -listen format; options which have their default
+// value are left out.
+func (ls listenerSpec) URL() string {
+	q := url.Values{}
+	if len(ls.Handlers) != 1 || ls.Handlers[0] != handlersPublic {
+		q.Set("handlers", strings.Join(ls.Handlers, ","))
+	}
+	if ls.Mode != 0 {
+		q.Set("mode", fmt.Sprintf("%#o", ls.Mode))
+	}
+	if ls.Owner != "" {
+		q.Set("owner", ls.Owner)
+	}
+	s := ls.Network + "://" + ls.Addr
+	if len(q) > 0 {
+		// keep the separators readable
+		s += "?" + strings.NewReplacer("%2C", ",", "%3A", ":").Replace(q.Encode())
+	}
+	return s
+}
+
+func (ls listenerSpec) serves(handlers string) bool {
+	for _, name := range ls.Handlers {
+		if name == handlers {
+			return true
+		}
+	}
+	return false
+}
+
+func parseListenerSpec(spec string) (listenerSpec, error) {
+	ls := listenerSpec{Network: "tcp", Addr: spec, Handlers: []string{handlersPublic}}
+	if !strings.Contains(spec, "://") {
+		return ls, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return ls, fmt.Errorf("invalid listener `%s`: %s", spec, err)
+	}
+	ls.Network, ls.Addr = u.Scheme, u.Host
+	switch ls.Network {
+	case "tcp", "tcp4", "tcp6":
+		if u.Path != "" {
+			return ls, fmt.Errorf("invalid listener `%s`: tcp listeners have no path", spec)
+		}
+	case "unix":
+		// unix://hync.sock is relative, unix:///run/hync.sock absolute
+		ls.Addr = u.Host + u.Path
+	default:
+		return ls, fmt.Errorf("invalid listener `%s`: unknown network `%s`", spec, ls.Network)
+	}
+	if ls.Addr == "" {
+		return ls, fmt.Errorf("invalid listener `%s`: address missing", spec)
+	}
+	q := u.Query()
+	if h := q.Get("handlers"); h != "" {
+		ls.Handlers = strings.Split(h, ",")
+		for _, name := range ls.Handlers {
+			switch name {
+			case handlersPublic, handlersAdmin, handlersMetrics:
+			default:
+				return ls, fmt.Errorf("invalid listener `%s`: unknown handler set `%s`", spec, name)
+			}
+		}
+	}
+	if m := q.Get("mode"); m != "" {
+		mode, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return ls, fmt.Errorf("invalid listener `%s`: mode must be octal", spec)
+		}
+		ls.Mode = os.FileMode(mode)
+	}
+	ls.Owner = q.Get("owner")
+	if ls.Network != "unix" && (ls.Mode != 0 || ls.Owner != "") {
+		return ls, fmt.Errorf("invalid listener `%s`: mode and owner only apply to unix sockets", spec)
+	}
+	for key := range q {
+		if key != "handlers" && key != "mode" && key != "owner" {
+			return ls, fmt.Errorf("invalid listener `%s`: unknown option `%s`", spec, key)
+		}
+	}
+	return ls, nil
+}
+
+// listenFlag collects the listeners given with -listen, which may be
+// repeated. The first -listen replaces the default.
+type listenFlag struct {
+	specs []listenerSpec
+	set   bool
+}
+
+func (lf *listenFlag) String() string {
+	if lf == nil {
+		return ""
+	}
+	s := make([]string, len(lf.specs))
+	for i := range lf.specs {
+		s[i] = lf.specs[i].URL()
+	}
+	return strings.Join(s, " ")
+}
+
+// reset makes the next Set replace the current listeners, see resetter.
+func (lf *listenFlag) reset() {
+	lf.set = false
+	lf.specs = nil
+}
+
+func (lf *listenFlag) Set(spec string) error {
+	ls, err := parseListenerSpec(spec)
+	if err != nil {
+		return err
+	}
+	if !lf.set {
+		lf.specs, lf.set = nil, true
+	}
+	lf.specs = append(lf.specs, ls)
+	return nil
+}
+
+// listen opens the listener described by ls. A socket file left behind by a
+// previous instance is removed first, unless something still accepts
+// connections on it.
+func listen(ls listenerSpec) (net.Listener, error) {
+	if ls.Network != "unix" {
+		return net.Listen(ls.Network, ls.Addr)
+	}
+	if err := removeStaleSocket(ls.Addr); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", ls.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// N.B. the socket file is removed when the listener is closed
+	if ls.Mode != 0 {
+		if err := os.Chmod(ls.Addr, ls.Mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if ls.Owner != "" {
+		uid, gid, err := lookupOwner(ls.Owner)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		if err := os.Chown(ls.Addr, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	log.Println("listen: removing stale socket", path)
+	return os.Remove(path)
+}
+
+// lookupOwner resolves user[:group]; without group, the user's primary
+// group is used.
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStr := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// publicMux holds the routes of the public handler set. It is kept apart
+// from http.DefaultServeMux, which packages like expvar register debug
+// endpoints on.
+var publicMux = http.NewServeMux()
+
+// listenerMux returns a mux serving the given handler sets. /healthz and
+// /readyz are served on every listener, the checks of /readyz only on
+// internal ones, as they tell about hync's environment.
+func listenerMux(handlers []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthState.healthzHandler)
+	readyz := healthState.publicReadyzHandler
+	for _, name := range handlers {
+		switch name {
+		case handlersPublic:
+			mux.Handle("/", publicMux)
+		case handlersAdmin:
+			mux.Handle("/admin/", NewAdminMux())
+			readyz = healthState.readyzHandler
+		case handlersMetrics:
+			mux.HandleFunc("/metrics", metricsHandler)
+			mux.Handle("/debug/vars", expvar.Handler())
+			readyz = healthState.readyzHandler
+		}
+	}
+	mux.HandleFunc("/readyz", readyz)
+	return mux
+}
+
+// httpListeners are the HTTP servers of all listeners.
+type httpListeners struct {
+	servers []*http.Server
+	wg      sync.WaitGroup
+}
+
+// Serve opens all listeners and serves their handler sets. TLS, if
+// configured, is used for tcp listeners serving the public handlers; unix
+// sockets and internal listeners stay plain.
+func (hl *httpListeners) Serve(specs []listenerSpec, tlsConf *tls.Config) error {
+	lns := []net.Listener{}
+	for _, ls := range specs {
+		ln, err := listen(ls)
+		if err != nil {
+			for i := range lns {
+				lns[i].Close()
+			}
+			return fmt.Errorf("%s: %s", ls, err)
+		}
+		scheme := "http"
+		if tlsConf != nil && ls.Network != "unix" && ls.serves(handlersPublic) {
+			ln = tls.NewListener(ln, tlsConf)
+			scheme = "https"
+		}
+		log.Printf("listening on %s://%s for %s handlers\n", scheme, ln.Addr(), strings.Join(ls.Handlers, ","))
+		lns = append(lns, ln)
+		hl.servers = append(hl.servers, &http.Server{Handler: listenerMux(ls.Handlers)})
+	}
+	for i := range lns {
+		hl.wg.Add(1)
+		go func(s *http.Server, ln net.Listener) {
+			defer hl.wg.Done()
+			if err := s.Serve(ln); err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}(hl.servers[i], lns[i])
+	}
+	return nil
+}
+
+// Shutdown stops all servers, see http.Server.Shutdown.
+func (hl *httpListeners) Shutdown(ctx context.Context) error {
+	var err error
+	for _, s := range hl.servers {
+		if e := s.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	hl.wg.Wait()
+	return err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseListenerSpec(t *testing.T) {
+	ls, err := parseListenerSpec("0.0.0.0:8888")
+	assert(t, err == nil && ls.Network == "tcp" && ls.Addr == "0.0.0.0:8888" && ls.serves(handlersPublic), "unexpected spec %v, %v", ls, err)
+
+	ls, err = parseListenerSpec("unix:///run/hync.sock?mode=0660&owner=hync:www-data&handlers=public,metrics")
+	assert(t, err == nil, "valid spec rejected: %v", err)
+	assert(t, ls.Network == "unix" && ls.Addr == "/run/hync.sock", "unexpected address %v", ls)
+	assert(t, ls.Mode == 0660 && ls.Owner == "hync:www-data", "unexpected mode/owner %v", ls)
+	assert(t, ls.serves(handlersMetrics) && !ls.serves(handlersAdmin), "unexpected handlers %v", ls.Handlers)
+
+	ls, err = parseListenerSpec("tcp6://[::1]:8889?handlers=admin")
+	assert(t, err == nil && ls.Network == "tcp6" && ls.Addr == "[::1]:8889" && !ls.serves(handlersPublic), "unexpected spec %v, %v", ls, err)
+
+	for _, spec := range []string{
+		"udp://:53",
+		"tcp://:8888?handlers=secret",
+		"tcp://:8888?mode=0600",
+		"unix:///run/hync.sock?mode=rw",
+		"unix:///run/hync.sock?color=blue",
+		"unix://",
+	} {
+		_, err := parseListenerSpec(spec)
+		assert(t, err != nil, "invalid spec %s accepted", spec)
+	}
+}
+
+func TestListenFlag(t *testing.T) {
+	lf := &listenFlag{specs: []listenerSpec{{Network: "tcp", Addr: "0.0.0.0:8888"}}}
+	lf.Set("unix://a.sock")
+	lf.Set("127.0.0.1:8080")
+	assert(t, lf.String() == "unix://a.sock tcp://127.0.0.1:8080", "default not replaced: %s", lf)
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hync.sock")
+
+	// leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(listenerSpec{Network: "unix", Addr: path, Mode: 0600})
+	assert(t, err == nil, "stale socket not cleaned up: %v", err)
+	fi, err := os.Stat(path)
+	assert(t, err == nil && fi.Mode().Perm() == 0600, "unexpected socket mode %v, %v", fi, err)
+
+	_, err = listen(listenerSpec{Network: "unix", Addr: path})
+	assert(t, err != nil && strings.Contains(err.Error(), "in use"), "socket in use was replaced: %v", err)
+
+	ln.Close()
+	_, err = os.Stat(path)
+	assert(t, os.IsNotExist(err), "socket file not removed on close")
+}
+
+func TestListenerMux(t *testing.T) {
+	get := func(handlers []string, path string) int {
+		rec := httptest.NewRecorder()
+		listenerMux(handlers).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+	public := []string{handlersPublic}
+	assert(t, get(public, "/debug/vars") == http.StatusNotFound, "public listeners must not serve /debug/vars")
+	assert(t, get(public, "/metrics") == http.StatusNotFound, "public listeners must not serve /metrics")
+	assert(t, get([]string{handlersMetrics}, "/debug/vars") == http.StatusOK, "metrics listeners should serve /debug/vars")
+}
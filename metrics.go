@@ -0,0 +1,285 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hiroapp-com/hync/comm"
+)
+
+// maxSeries limits the number of label combinations per metric; further
+// combinations are counted with all labels set to "other". Event names
+// come from clients, so they must not blow up the number of series.
+const maxSeries = 500
+
+var (
+	eventsReceived    = newCounterVec("hync_events_received_total", "Events received from clients.", "name")
+	eventsSent        = newCounterVec("hync_events_sent_total", "Events sent to clients.", "name")
+	handleDuration    = newHistogramVec("hync_handle_duration_seconds", "Time spent in srv.Handle per incoming event.", []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}, "name")
+	queueDepth        = newHistogramVec("hync_queue_depth", "Number of events in a client's queue after queueing an event.", []float64{0, 1, 2, 4, 8, 16, 32, 64, 128})
+	queueTimeouts     = newCounterVec("hync_queue_timeouts_total", "Events which could not be queued within -queue_timeout.", "policy")
+	handshakeFailures = newCounterVec("hync_handshake_failures_total", "Rejected client handshakes.", "transport", "reason")
+	commRequests      = newCounterVec("hync_comm_requests_total", "Comm requests handled by the providers.", "provider", "kind", "outcome")
+)
+
+// metricFamily is a metric in the Prometheus text format.
+type metricFamily interface {
+	writeTo(w io.Writer)
+}
+
+// families holds all metrics created with newCounterVec and
+// newHistogramVec, in order of creation.
+var families = []metricFamily{}
+
+// labelKey joins label values to a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels returns {name="value",...} for the given labels, or "" if
+// there are none.
+func formatLabels(names []string, key string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escapeLabel(v)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// seriesKey returns the map key for values, or the "other" key if the
+// metric already has maxSeries series.
+func seriesKey(values []string, n int, exists bool) string {
+	if exists || n < maxSeries {
+		return labelKey(values)
+	}
+	other := make([]string, len(values))
+	for i := range other {
+		other[i] = "other"
+	}
+	return labelKey(other)
+}
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	cv := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	families = append(families, cv)
+	return cv
+}
+
+// Inc increments the counter with the given label values.
+func (cv *counterVec) Inc(values ...string) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	_, exists := cv.values[labelKey(values)]
+	cv.values[seriesKey(values, len(cv.values), exists)]++
+}
+
+func (cv *counterVec) writeTo(w io.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cv.name, cv.help, cv.name)
+	for _, key := range sortedKeys(cv.values) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, formatLabels(cv.labels, key), formatFloat(cv.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	bounds     []float64
+
+	mu    sync.Mutex
+	hists map[string]*histogram
+}
+
+func newHistogramVec(name, help string, bounds []float64, labels ...string) *histogramVec {
+	hv := &histogramVec{name: name, help: help, labels: labels, bounds: bounds, hists: map[string]*histogram{}}
+	families = append(families, hv)
+	return hv
+}
+
+// Observe adds v to the histogram with the given label values.
+func (hv *histogramVec) Observe(v float64, values ...string) {
+	hv.mu.Lock()
+	h, exists := hv.hists[labelKey(values)]
+	if !exists {
+		key := seriesKey(values, len(hv.hists), false)
+		if h = hv.hists[key]; h == nil {
+			h = &histogram{bounds: hv.bounds, counts: make([]int64, len(hv.bounds)+1)}
+			hv.hists[key] = h
+		}
+	}
+	hv.mu.Unlock()
+	h.Observe(v)
+}
+
+func (hv *histogramVec) writeTo(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+	keys := make([]string, 0, len(hv.hists))
+	for key := range hv.hists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeHistogram(w, hv.name, hv.labels, key, hv.hists[key])
+	}
+}
+
+// writeHistogram writes the cumulative buckets, sum and count of h.
+func writeHistogram(w io.Writer, name string, labels []string, key string, h *histogram) {
+	counts, sum, total := h.snapshot()
+	cumulative := int64(0)
+	for i := range counts {
+		cumulative += counts[i]
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels, key, "le", formatFloat(le)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(labels, key), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(labels, key), total)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeGauge writes a single, unlabeled sample.
+func writeGauge(w io.Writer, typ, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+}
+
+// writeConnections writes the number of live connections per transport.
+func writeConnections(w io.Writer) {
+	perTransport := map[string]float64{"ws": 0, "sse": 0, "tcp": 0}
+	registry.mu.RLock()
+	for _, c := range registry.conns {
+		perTransport[c.Transport]++
+	}
+	registry.mu.RUnlock()
+	fmt.Fprintf(w, "# HELP hync_connections Live client connections.\n# TYPE hync_connections gauge\n")
+	for _, transport := range sortedKeys(perTransport) {
+		fmt.Fprintf(w, "hync_connections{transport=\"%s\"} %s\n", transport, formatFloat(perTransport[transport]))
+	}
+}
+
+// writeStats writes the counters and histograms in stats, which are also
+// available at /debug/vars, as hync_stat_<name>.
+func writeStats(w io.Writer) {
+	stats.Do(func(kv expvar.KeyValue) {
+		name := "hync_stat_" + kv.Key
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			fmt.Fprintf(w, "# TYPE %s untyped\n%s %d\n", name, name, v.Value())
+		case *histogram:
+			fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+			writeHistogram(w, name, nil, "", v)
+		}
+	})
+}
+
+var startTime = time.Now()
+
+// writeRuntime writes Go runtime and process stats, named like the ones of
+// the Prometheus Go client.
+func writeRuntime(w io.Writer) {
+	ms := runtime.MemStats{}
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintf(w, "# HELP go_info Information about the Go environment.\n# TYPE go_info gauge\ngo_info{version=\"%s\"} 1\n", runtime.Version())
+	writeGauge(w, "gauge", "go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	writeGauge(w, "gauge", "go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	writeGauge(w, "counter", "go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(ms.TotalAlloc))
+	writeGauge(w, "gauge", "go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys))
+	writeGauge(w, "counter", "go_memstats_mallocs_total", "Total number of mallocs.", float64(ms.Mallocs))
+	writeGauge(w, "counter", "go_memstats_frees_total", "Total number of frees.", float64(ms.Frees))
+	writeGauge(w, "gauge", "go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(ms.HeapAlloc))
+	writeGauge(w, "gauge", "go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(ms.HeapInuse))
+	writeGauge(w, "gauge", "go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	writeGauge(w, "gauge", "go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", float64(ms.StackInuse))
+	writeGauge(w, "gauge", "go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(ms.NextGC))
+	writeGauge(w, "gauge", "go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(ms.LastGC)/1e9)
+	writeGauge(w, "counter", "go_gc_cycles_total", "Number of completed GC cycles.", float64(ms.NumGC))
+	writeGauge(w, "counter", "go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", float64(ms.PauseTotalNs)/1e9)
+	writeGauge(w, "gauge", "process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(startTime.UnixNano())/1e9)
+}
+
+// metricsHandler serves all metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeConnections(w)
+	for _, f := range families {
+		f.writeTo(w)
+	}
+	writeStats(w)
+	writeRuntime(w)
+}
+
+// instrumentComm wraps the handler of a comm provider, so that its
+// requests are counted by kind and outcome.
+func instrumentComm(provider string, handler comm.Handler) comm.Handler {
+	return func(req comm.Request) error {
+		err := handler(req)
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		commRequests.Inc(provider, req.Kind, outcome)
+		healthState.recordProvider(provider, err)
+		return err
+	}
+}
+
+// handshakeFailed counts a rejected handshake.
+func handshakeFailed(transport, reason string) {
+	handshakeFailures.Inc(transport, reason)
+}
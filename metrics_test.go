@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hiroapp-com/hync/comm"
+)
+
+func TestCounterVec(t *testing.T) {
+	cv := &counterVec{name: "test_total", help: "Test.", labels: []string{"name"}, values: map[string]float64{}}
+	cv.Inc("a")
+	cv.Inc("a")
+	cv.Inc(`b"`)
+	buf := &bytes.Buffer{}
+	cv.writeTo(buf)
+	want := "# HELP test_total Test.\n# TYPE test_total counter\ntest_total{name=\"a\"} 2\ntest_total{name=\"b\\\"\"} 1\n"
+	assert(t, buf.String() == want, "unexpected output:\n%s", buf)
+}
+
+func TestSeriesCap(t *testing.T) {
+	cv := &counterVec{name: "test_total", labels: []string{"name"}, values: map[string]float64{}}
+	for i := 0; i < maxSeries+10; i++ {
+		cv.Inc(randomID())
+	}
+	assert(t, len(cv.values) == maxSeries+1, "series not capped: %d", len(cv.values))
+	assert(t, cv.values["other"] == 10, "overflow not counted as other: %v", cv.values["other"])
+}
+
+func TestHistogramVec(t *testing.T) {
+	hv := &histogramVec{name: "test_seconds", labels: []string{"name"}, bounds: []float64{.1, 1}, hists: map[string]*histogram{}}
+	hv.Observe(.05, "a")
+	hv.Observe(.5, "a")
+	hv.Observe(5, "a")
+	buf := &bytes.Buffer{}
+	hv.writeTo(buf)
+	for _, line := range []string{
+		`test_seconds_bucket{name="a",le="0.1"} 1`,
+		`test_seconds_bucket{name="a",le="1"} 2`,
+		`test_seconds_bucket{name="a",le="+Inf"} 3`,
+		`test_seconds_sum{name="a"} 5.55`,
+		`test_seconds_count{name="a"} 3`,
+	} {
+		assert(t, strings.Contains(buf.String(), line+"\n"), "missing %s in:\n%s", line, buf)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	handler := instrumentComm("test", func(req comm.Request) error { return errors.New("down") })
+	handler(comm.Request{Kind: "verify"})
+	handshakeFailed("ws", "origin")
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`hync_connections{transport="ws"}`,
+		`hync_comm_requests_total{provider="test",kind="verify",outcome="error"} 1`,
+		`hync_handshake_failures_total{transport="ws",reason="origin"}`,
+		`# TYPE hync_handle_duration_seconds histogram`,
+		`go_goroutines `,
+	} {
+		assert(t, strings.Contains(body, line), "missing %s in /metrics", line)
+	}
+	assert(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"), "unexpected content type")
+}
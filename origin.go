@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var defaultOrigins = []string{"http://localhost:5000", "https://beta.hiroapp.com", "https://www.hiroapp.com"}
+
+// OriginPolicy describes which values of the Origin header are allowed to
+// open a WebSocket connection.
+//
+// Each entry in Origins is of the form [scheme://]host[:port], where host may
+// start with "*." to match any subdomain (but not the domain itself) and port
+// may be "*" to match any (or no) port. Entries without a scheme match any
+// scheme. If Schemes is non-empty, origins with other schemes are rejected.
+type OriginPolicy struct {
+	Origins      []string `json:"origins"`
+	Schemes      []string `json:"schemes"`
+	AllowMissing bool     `json:"allow_missing"`
+	rules        []originRule
+}
+
+type originRule struct {
+	scheme string
+	host   string
+	port   string
+}
+
+func (p *OriginPolicy) compile() error {
+	p.rules = make([]originRule, 0, len(p.Origins))
+	for _, s := range p.Origins {
+		rule, err := parseOriginRule(s)
+		if err != nil {
+			return err
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return nil
+}
+
+func parseOriginRule(s string) (originRule, error) {
+	rule := originRule{}
+	s = strings.ToLower(strings.TrimSpace(s))
+	if i := strings.Index(s, "://"); i >= 0 {
+		rule.scheme, s = s[:i], s[i+3:]
+	}
+	rule.host = s
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		rule.host, rule.port = host, port
+	}
+	if rule.host == "" || strings.Contains(rule.host[1:], "*") || (rule.host[0] == '*' && !strings.HasPrefix(rule.host, "*.")) {
+		return originRule{}, fmt.Errorf("origin: invalid rule `%s`", s)
+	}
+	return rule, nil
+}
+
+func (rule originRule) match(scheme, host, port string) bool {
+	if rule.scheme != "" && rule.scheme != scheme {
+		return false
+	}
+	if rule.port != "*" && rule.port != port {
+		return false
+	}
+	if strings.HasPrefix(rule.host, "*.") {
+		suffix := rule.host[1:]
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return rule.host == host
+}
+
+// Allows reports whether origin is accepted by the policy.
+func (p *OriginPolicy) Allows(origin string) bool {
+	if origin == "" {
+		return p.AllowMissing
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host, port := u.Host, ""
+	if h, pt, err := net.SplitHostPort(u.Host); err == nil {
+		host, port = h, pt
+	}
+	if len(p.Schemes) > 0 && !contains(p.Schemes, u.Scheme) {
+		return false
+	}
+	for i := range p.rules {
+		if p.rules[i].match(u.Scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginChecker applies an OriginPolicy to incoming handshakes. The policy is
+// either given statically or loaded from a JSON file which maps environment
+// names to policies, e.g.
+//
+//	{
+//	  "production": {"origins": ["https://www.hiroapp.com", "https://beta.hiroapp.com"]},
+//	  "staging":    {"origins": ["*.staging.hiroapp.com"], "schemes": ["https"], "allow_missing": true}
+//	}
+//
+// in which case Reload re-reads the file.
+type OriginChecker struct {
+	mu     sync.RWMutex
+	policy OriginPolicy
+	path   string
+	env    string
+}
+
+func NewOriginChecker(policy OriginPolicy) (*OriginChecker, error) {
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return &OriginChecker{policy: policy}, nil
+}
+
+func LoadOriginChecker(path, env string) (*OriginChecker, error) {
+	oc := &OriginChecker{path: path, env: env}
+	if err := oc.Reload(); err != nil {
+		return nil, err
+	}
+	return oc, nil
+}
+
+// Reload re-reads the policy file. If the checker was not created from a
+// file, Reload is a no-op. On error the current policy is kept.
+func (oc *OriginChecker) Reload() error {
+	if oc.path == "" {
+		return nil
+	}
+	f, err := os.Open(oc.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	envs := map[string]OriginPolicy{}
+	if err = json.NewDecoder(f).Decode(&envs); err != nil {
+		return fmt.Errorf("origin: cannot parse %s: %s", oc.path, err)
+	}
+	policy, ok := envs[oc.env]
+	if !ok {
+		return fmt.Errorf("origin: no policy for environment `%s` in %s", oc.env, oc.path)
+	}
+	if err = policy.compile(); err != nil {
+		return err
+	}
+	oc.mu.Lock()
+	oc.policy = policy
+	oc.mu.Unlock()
+	log.Printf("origin: loaded policy `%s` from %s (%d origins, allow_missing: %v)", oc.env, oc.path, len(policy.Origins), policy.AllowMissing)
+	return nil
+}
+
+// Check is suitable as websocket.Upgrader.CheckOrigin.
+func (oc *OriginChecker) Check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	oc.mu.RLock()
+	ok := oc.policy.Allows(origin)
+	oc.mu.RUnlock()
+	if !ok {
+		log.Printf("ws: rejected handshake from %s with origin `%s`", r.RemoteAddr, origin)
+		count("ws_origin_rejected")
+	}
+	return ok
+}
+
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	policy := OriginPolicy{Origins: []string{
+		"http://localhost:5000",
+		"https://www.hiroapp.com",
+		"*.staging.hiroapp.com",
+		"https://preview.hiroapp.com:*",
+	}}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"":                                  false,
+		"http://localhost:5000":             true,
+		"http://localhost:5001":             false,
+		"http://localhost":                  false,
+		"https://www.hiroapp.com":           true,
+		"HTTPS://WWW.HIROAPP.COM":           true,
+		"http://www.hiroapp.com":            false,
+		"https://www.hiroapp.com:8443":      false,
+		"https://pr-12.staging.hiroapp.com": true,
+		"http://pr-12.staging.hiroapp.com":  true,
+		"https://a.b.staging.hiroapp.com":   true,
+		"https://staging.hiroapp.com":       false,
+		"https://evilstaging.hiroapp.com":   false,
+		"https://preview.hiroapp.com:3000":  true,
+		"https://preview.hiroapp.com":       true,
+		"null":                              false,
+	}
+	for origin, expected := range cases {
+		assert(t, policy.Allows(origin) == expected, "origin `%s`: expected %v", origin, expected)
+	}
+}
+
+func TestOriginPolicySchemes(t *testing.T) {
+	policy := OriginPolicy{Origins: []string{"*.hiroapp.com"}, Schemes: []string{"https"}, AllowMissing: true}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, policy.Allows(""), "missing origin should be allowed")
+	assert(t, policy.Allows("https://beta.hiroapp.com"), "https subdomain should be allowed")
+	assert(t, !policy.Allows("http://beta.hiroapp.com"), "http should be rejected")
+}
+
+func TestInvalidOriginRules(t *testing.T) {
+	for _, rule := range []string{"", "*hiroapp.com", "www.*.hiroapp.com", "https://"} {
+		policy := OriginPolicy{Origins: []string{rule}}
+		assert(t, policy.compile() != nil, "rule `%s` should be invalid", rule)
+	}
+}
+
+func assert(t *testing.T, cond bool, msg string, args ...interface{}) bool {
+	if !cond {
+		t.Errorf(msg, args...)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+)
+
+// currentProtocol is the newest version of the wire protocol.
+const currentProtocol = 1
+
+// protocol is a version of the wire protocol. A version whose message format
+// differs from the current one (i.e. the one diffsync's JsonAdapter
+// understands) translates its messages with toCurrent and fromCurrent, see
+// versionedCodec; nil means the message format did not change. v0 and v1
+// share the format, so neither needs a translation yet.
+type protocol struct {
+	Version     int
+	toCurrent   func(msg map[string]interface{}) error
+	fromCurrent func(msg map[string]interface{}) error
+}
+
+var protocols = map[int]*protocol{
+	// v0 is the implicit version of /0/ws and the unversioned subprotocols
+	0: {Version: 0},
+	// v1 is the first explicitly versioned protocol. Its message format is
+	// the same as v0's; the only difference is that v1 clients can resume
+	// their sessions (see resume.go): events for them carry a seq, and
+	// session-ack and session-resume are handled by hync itself.
+	1: {Version: 1},
+}
+
+var (
+	deprecatedProtocols = map[int]bool{}
+	droppedProtocols    = map[int]bool{}
+)
+
+// setupProtocols applies the -protocols_deprecated and -protocols_dropped
+// flags.
+func setupProtocols() (err error) {
+	if deprecatedProtocols, err = parseVersions(*protocolsDeprecated); err != nil {
+		return err
+	}
+	if droppedProtocols, err = parseVersions(*protocolsDropped); err != nil {
+		return err
+	}
+	if droppedProtocols[currentProtocol] || deprecatedProtocols[currentProtocol] {
+		return fmt.Errorf("the current protocol version %d cannot be deprecated or dropped", currentProtocol)
+	}
+	return nil
+}
+
+func parseVersions(spec string) (map[int]bool, error) {
+	versions := map[int]bool{}
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || protocols[v] == nil {
+			return nil, fmt.Errorf("unknown protocol version `%s`", s)
+		}
+		versions[v] = true
+	}
+	return versions, nil
+}
+
+// Subprotocols are named hync[.v<version>][.<codec>], e.g. "hync.v1" or
+// "hync.v1.msgpack". Without version, the version of the route is used.
+// Without codec, JSON is used.
+func subprotocol(version int, codecName string) string {
+	name := subprotoJSON
+	if version > 0 {
+		name += ".v" + strconv.Itoa(version)
+	}
+	if codecName != "json" {
+		name += "." + codecName
+	}
+	return name
+}
+
+// parseSubprotocol returns the version (-1 if unversioned) and codec name
+// selected by a subprotocol.
+func parseSubprotocol(s string) (version int, codecName string, ok bool) {
+	parts := strings.Split(s, ".")
+	if parts[0] != subprotoJSON {
+		return 0, "", false
+	}
+	parts = parts[1:]
+	version, codecName = -1, "json"
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v") {
+		v, err := strconv.Atoi(parts[0][1:])
+		if err != nil || protocols[v] == nil {
+			return 0, "", false
+		}
+		version, parts = v, parts[1:]
+	}
+	if len(parts) > 0 {
+		codecName, parts = parts[0], parts[1:]
+	}
+	if _, known := codecs[codecName]; !known || len(parts) > 0 {
+		return 0, "", false
+	}
+	return version, codecName, true
+}
+
+// supportedSubprotocols lists all subprotocols, in order of preference.
+func supportedSubprotocols() []string {
+	names := []string{}
+	for v := currentProtocol; v >= 0; v-- {
+		if protocols[v] == nil {
+			continue
+		}
+		names = append(names, subprotocol(v, "json"), subprotocol(v, "msgpack"))
+	}
+	return names
+}
+
+// routeVersion returns the protocol version of a versioned route like
+// /1/ws, or 0 if the path is not versioned.
+func routeVersion(path string) int {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if v, err := strconv.Atoi(parts[0]); err == nil {
+		return v
+	}
+	return 0
+}
+
+// negotiateProtocol determines protocol version and codec of a WebSocket
+// handshake, mirroring the Upgrader's choice of subprotocol: the first
+// subprotocol requested by the client which the server supports wins.
+func negotiateProtocol(r *http.Request, supported []string) (*protocol, string, error) {
+	version, codecName := routeVersion(r.URL.Path), "json"
+	for _, requested := range websocket.Subprotocols(r) {
+		if !contains(supported, requested) {
+			continue
+		}
+		if v, c, ok := parseSubprotocol(requested); ok {
+			if v >= 0 {
+				version = v
+			}
+			codecName = c
+			break
+		}
+	}
+	return lookupProtocol(version, codecName)
+}
+
+// rejectProtocol answers a request for an unknown or dropped protocol
+// version; every transport uses the same status.
+func rejectProtocol(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusUpgradeRequired)
+}
+
+func lookupProtocol(version int, codecName string) (*protocol, string, error) {
+	proto, ok := protocols[version]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown protocol version %d", version)
+	}
+	if droppedProtocols[version] {
+		count("protocol_dropped_rejected")
+		return nil, "", fmt.Errorf("protocol version %d is no longer supported, please upgrade to version %d", version, currentProtocol)
+	}
+	return proto, codecName, nil
+}
+
+// deprecationNotice is sent to clients right after connecting if they use
+// a deprecated protocol version.
+type deprecationNotice struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	Current int    `json:"current"`
+	Sunset  string `json:"sunset,omitempty"`
+}
+
+// deprecationMsg returns the JSON encoded deprecation notice for proto, or
+// nil if proto is not deprecated.
+func deprecationMsg(proto *protocol) []byte {
+	if !deprecatedProtocols[proto.Version] {
+		return nil
+	}
+	count("protocol_deprecated_conns")
+	msg, _ := json.Marshal(deprecationNotice{
+		Name:    "server-deprecation",
+		Version: proto.Version,
+		Current: currentProtocol,
+		Sunset:  *protocolSunset,
+	})
+	return msg
+}
+
+// versionedCodec translates the messages of a protocol version before
+// handing them to the underlying codec.
+type versionedCodec struct {
+	Codec
+	proto *protocol
+}
+
+func newVersionedCodec(proto *protocol, codecName string) Codec {
+	return versionedCodec{Codec: codecs[codecName], proto: proto}
+}
+
+func (c versionedCodec) MsgToEvent(msg []byte) (diffsync.Event, error) {
+	if c.proto.toCurrent != nil {
+		var err error
+		if msg, err = c.translate(msg, c.proto.toCurrent); err != nil {
+			return diffsync.Event{}, err
+		}
+	}
+	return c.Codec.MsgToEvent(msg)
+}
+
+func (c versionedCodec) EventToMsg(event diffsync.Event) ([]byte, error) {
+	msg, err := c.Codec.EventToMsg(event)
+	if err != nil || c.proto.fromCurrent == nil {
+		return msg, err
+	}
+	return c.translate(msg, c.proto.fromCurrent)
+}
+
+func (c versionedCodec) translate(msg []byte, fn func(map[string]interface{}) error) ([]byte, error) {
+	jsonMsg, err := c.ToJSON(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(jsonMsg))
+	dec.UseNumber()
+	if err = dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	if err = fn(m); err != nil {
+		return nil, err
+	}
+	if jsonMsg, err = json.Marshal(m); err != nil {
+		return nil, err
+	}
+	return c.FromJSON(jsonMsg)
+}
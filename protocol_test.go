@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+)
+
+func TestParseSubprotocol(t *testing.T) {
+	cases := []struct {
+		name    string
+		version int
+		codec   string
+		ok      bool
+	}{
+		{"hync", -1, "json", true},
+		{"hync.msgpack", -1, "msgpack", true},
+		{"hync.v1", 1, "json", true},
+		{"hync.v1.msgpack", 1, "msgpack", true},
+		{"hync.v99", 0, "", false},
+		{"hync.cbor", 0, "", false},
+		{"hync.v1.msgpack.gz", 0, "", false},
+		{"chat", 0, "", false},
+	}
+	for _, c := range cases {
+		version, codecName, ok := parseSubprotocol(c.name)
+		assert(t, version == c.version && codecName == c.codec && ok == c.ok, "parseSubprotocol(%s) = %d, %s, %v", c.name, version, codecName, ok)
+	}
+	for _, name := range supportedSubprotocols() {
+		_, _, ok := parseSubprotocol(name)
+		assert(t, ok, "supported subprotocol `%s` does not parse", name)
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	defer func(dropped map[int]bool) { droppedProtocols = dropped }(droppedProtocols)
+	supported := supportedSubprotocols()
+	handshake := func(path, subprotocols string) (*protocol, string, error) {
+		r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		if subprotocols != "" {
+			r.Header.Set("Sec-Websocket-Protocol", subprotocols)
+		}
+		return negotiateProtocol(r, supported)
+	}
+	cases := []struct {
+		path, subprotocols string
+		version            int
+		codec              string
+	}{
+		{"/0/ws", "", 0, "json"},
+		{"/0/ws", "hync", 0, "json"},
+		{"/1/ws", "hync", 1, "json"},
+		{"/1/ws", "hync.msgpack", 1, "msgpack"},
+		{"/0/ws", "hync.v1.msgpack, hync", 1, "msgpack"},
+		{"/0/ws", "chat, hync.v1", 1, "json"},
+	}
+	for _, c := range cases {
+		proto, codecName, err := handshake(c.path, c.subprotocols)
+		if assert(t, err == nil, "%s %s: unexpected error %s", c.path, c.subprotocols, err) {
+			assert(t, proto.Version == c.version && codecName == c.codec, "%s %s: got v%d %s", c.path, c.subprotocols, proto.Version, codecName)
+		}
+	}
+
+	droppedProtocols = map[int]bool{0: true}
+	_, _, err := handshake("/0/ws", "hync")
+	assert(t, err != nil, "dropped protocol version should be rejected")
+	_, _, err = handshake("/0/ws", "hync.v1")
+	assert(t, err == nil, "current protocol version should be accepted via subprotocol: %s", err)
+}
+
+func TestDroppedProtocolStatus(t *testing.T) {
+	defer func(dropped map[int]bool) { droppedProtocols = dropped }(droppedProtocols)
+	droppedProtocols = map[int]bool{0: true}
+	_, ws := testWsServer(t)
+	defer ws.Close()
+	_, sse := testSSEServer(t, nil)
+	defer sse.Close()
+
+	_, resp, err := dialWs(ws, "/0/ws")
+	assert(t, err != nil && resp != nil && resp.StatusCode == http.StatusUpgradeRequired, "ws: dropped version should be rejected with 426: %v", err)
+	resp, err = http.Get(sse.URL + "/0/sse")
+	if assert(t, err == nil, "sse: %v", err) {
+		resp.Body.Close()
+		assert(t, resp.StatusCode == http.StatusUpgradeRequired, "sse: dropped version should be rejected with 426, got %d", resp.StatusCode)
+	}
+}
+
+func TestVersionedCodecTranslation(t *testing.T) {
+	// a made-up version which calls the event's name "event"
+	proto := &protocol{
+		Version: 42,
+		toCurrent: func(msg map[string]interface{}) error {
+			msg["name"] = msg["event"]
+			delete(msg, "event")
+			return nil
+		},
+		fromCurrent: func(msg map[string]interface{}) error {
+			msg["event"] = msg["name"]
+			delete(msg, "name")
+			return nil
+		},
+	}
+	for _, codecName := range []string{"json", "msgpack"} {
+		c := newVersionedCodec(proto, codecName)
+		msg, _ := c.FromJSON([]byte(`{"event": "client-ehlo", "sid": "abc", "tag": "client01"}`))
+		event, err := c.MsgToEvent(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, event.Name == "client-ehlo" && event.SID == "abc", "%s: translation to current failed: %#v", codecName, event)
+		msg, err = c.EventToMsg(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonMsg, _ := c.ToJSON(msg)
+		back, _ := adapter.MsgToEvent(jsonMsg)
+		assert(t, back.Name == "", "%s: name should have been translated to event: %s", codecName, jsonMsg)
+	}
+}
+
+func TestDeprecationMsg(t *testing.T) {
+	defer func(deprecated map[int]bool) { deprecatedProtocols = deprecated }(deprecatedProtocols)
+	deprecatedProtocols = map[int]bool{0: true}
+	assert(t, deprecationMsg(protocols[0]) != nil, "v0 should get a deprecation notice")
+	assert(t, deprecationMsg(protocols[1]) == nil, "v1 should not get a deprecation notice")
+}
+
+func TestV0AndV1Clients(t *testing.T) {
+	// both versions share the message format
+	for name, jsonMsg := range testMsgs {
+		event, _ := adapter.MsgToEvent([]byte(jsonMsg))
+		for _, codecName := range []string{"json", "msgpack"} {
+			c0, c1 := newVersionedCodec(protocols[0], codecName), newVersionedCodec(protocols[1], codecName)
+			v0, _ := c0.EventToMsg(event)
+			v1, _ := c1.EventToMsg(event)
+			e0, _ := c0.MsgToEvent(v1)
+			e1, _ := c1.MsgToEvent(v0)
+			assert(t, reflect.DeepEqual(e0, event) && reflect.DeepEqual(e1, event), "%s (%s): v0 and v1 messages differ", name, codecName)
+		}
+	}
+
+	// ... and talk to the same server, but only v1 can resume sessions
+	defer func(rs *resumeStore) { resumes = rs }(resumes)
+	resumes = newResumeStore()
+	origins, err := NewOriginChecker(OriginPolicy{AllowMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWsHandler(nil, origins, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/0/ws", h)
+	mux.Handle("/1/ws", h)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	dial := func(path string) *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return ws
+	}
+	v0, v1 := dial("/0/ws"), dial("/1/ws")
+	defer func() {
+		v0.Close()
+		v1.Close()
+		h.conns.wait()
+	}()
+
+	replies := map[string][]json.RawMessage{}
+	for path, ws := range map[string]*websocket.Conn{"/0/ws": v0, "/1/ws": v1} {
+		ws.WriteMessage(websocket.TextMessage, []byte(`[{"name": 42}]`))
+		msgs := []json.RawMessage{}
+		err := ws.ReadJSON(&msgs)
+		assert(t, err == nil && len(msgs) == 1, "%s: expected an error message, got %v", path, err)
+		replies[path] = msgs
+	}
+	assert(t, string(replies["/0/ws"][0]) == string(replies["/1/ws"][0]), "v0 and v1 errors differ:\n%s\n%s", replies["/0/ws"], replies["/1/ws"])
+
+	v1.WriteMessage(websocket.TextMessage, []byte(`[{"name": "session-resume", "sid": "s1", "tag": "t", "last_seq": 0}]`))
+	resumed := []resumeReply{}
+	err = v1.ReadJSON(&resumed)
+	assert(t, err == nil && len(resumed) == 1 && resumed[0].Status == "resync-required", "v1: expected session-resume reply, got %v %v", resumed, err)
+	oe, live := resumes.record(diffsync.Event{Name: "res-sync", SID: "s1"})
+	assert(t, live != nil && oe.seq == 1, "v1 connection should serve its session")
+}
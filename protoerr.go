@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// error codes of protocol errors
+const (
+	errInvalidMsgList = "invalid-msglist"
+	errInvalidMsg     = "invalid-message"
+	errThrottled      = "throttled"
+)
+
+var errRateLimited = errors.New("rate limit exceeded, slow down")
+
+// protocolError is sent to clients as an "error" message if they sent
+// something hync could not understand. Tag is the tag of the offending
+// message, if it could be determined.
+type protocolError struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag,omitempty"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func newProtocolError(code string, msg []byte, err error) protocolError {
+	perr := protocolError{Name: "error", Code: code, Reason: err.Error()}
+	if msg != nil {
+		tagged := struct {
+			Tag string `json:"tag"`
+		}{}
+		json.Unmarshal(msg, &tagged)
+		perr.Tag = tagged.Tag
+	}
+	return perr
+}
+
+func (perr protocolError) Msg() []byte {
+	msg, _ := json.Marshal(perr)
+	return msg
+}
+
+func (perr protocolError) Error() string {
+	return fmt.Sprintf("%s (tag: `%s`): %s", perr.Code, perr.Tag, perr.Reason)
+}
+
+// tooManyProtocolErrors reports whether a client which sent n malformed
+// messages should be disconnected.
+func tooManyProtocolErrors(n int) bool {
+	return *protocolStrict || (*protocolMaxErrors > 0 && n > *protocolMaxErrors)
+}
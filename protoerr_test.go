@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestProtocolErrorMsg(t *testing.T) {
+	perr := newProtocolError(errInvalidMsg, []byte(`{"name": "res-sync", "tag": "client01", "res": 42}`), errors.New("invalid res"))
+	decoded := map[string]string{}
+	if err := json.Unmarshal(perr.Msg(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, decoded["name"] == "error", "name should be `error`, is `%s`", decoded["name"])
+	assert(t, decoded["tag"] == "client01", "tag of offending message expected, got `%s`", decoded["tag"])
+	assert(t, decoded["code"] == errInvalidMsg, "unexpected code `%s`", decoded["code"])
+	assert(t, decoded["reason"] == "invalid res", "unexpected reason `%s`", decoded["reason"])
+
+	perr = newProtocolError(errInvalidMsgList, []byte(`garbage`), errors.New("invalid json"))
+	assert(t, perr.Tag == "", "no tag expected for unparsable message, got `%s`", perr.Tag)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hiroapp-com/diffsync"
+)
+
+// policies for clients whose outbound queue is full (-queue_policy)
+const (
+	// wait up to -queue_timeout for the client, then drop the event
+	queueBlock = "block"
+	// make room by dropping the oldest queued event
+	queueDropOldest = "drop-oldest"
+	// wait up to -queue_timeout for the client, then disconnect it
+	queueDisconnect = "disconnect"
+)
+
+func checkQueuePolicy(policy string) error {
+	switch policy {
+	case queueBlock, queueDropOldest, queueDisconnect:
+		return nil
+	}
+	return fmt.Errorf("invalid queue policy `%s`, must be one of %s, %s, %s", policy, queueBlock, queueDropOldest, queueDisconnect)
+}
+
+// outEvent is an entry of a client's outbound queue: either an event, which
+// carries a sequence number if the client can resume its session, or a raw
+// JSON message generated by hync itself. cid is the correlation id of the
+// incoming event which caused it.
+type outEvent struct {
+	diffsync.Event
+	seq uint64
+	raw []byte
+	cid string
+}
+
+// name returns the event's name for metrics; raw messages are replies to
+// control messages.
+func (oe outEvent) name() string {
+	if oe.raw != nil {
+		return "control"
+	}
+	return oe.Name
+}
+
+// clientQueue is a client's outbound queue. kick is called if the client
+// falls behind under the disconnect policy.
+type clientQueue struct {
+	to_client chan outEvent
+	kick      func()
+}
+
+// newQueue creates a client's outbound queue with -queue_size slots.
+func newQueue(kick func()) *clientQueue {
+	return &clientQueue{to_client: make(chan outEvent, *queueSize), kick: kick}
+}
+
+// push queues an event according to -queue_policy.
+func (q *clientQueue) push(oe outEvent) error {
+	if *queuePolicy == queueDropOldest {
+		err := enqueueDropOldest(q.to_client, oe)
+		queueDepth.Observe(float64(len(q.to_client)))
+		return err
+	}
+	select {
+	case q.to_client <- oe:
+		queueDepth.Observe(float64(len(q.to_client)))
+		return nil
+	case <-time.After(*queueTimeout):
+	}
+	queueTimeouts.Inc(*queuePolicy)
+	if *queuePolicy == queueDisconnect {
+		log.Printf("queue: [%s] client fell behind, disconnecting", oe.cid)
+		count("queue_disconnects")
+		q.kick()
+	} else {
+		log.Printf("queue: [%s] timeout, dropping event for client %v", oe.cid, oe.Event)
+		count("queue_timeouts")
+	}
+	return diffsync.EventTimeoutError{}
+}
+
+// clientContext returns the Context which is passed down to the server with
+// an event received from a client; cid is the event's correlation id.
+// Events for the client are pushed to q, or, if the client can resume its
+// sessions (sessions is not nil), recorded in the session's resume buffer
+// and pushed to the queue of whichever connection currently serves the
+// session. Sessions created by the event are served by the client's
+// connection.
+func clientContext(q *clientQueue, sessions *sessionSet, cid string) diffsync.Context {
+	// inject only Client into Context passed down to server
+	return diffsync.Context{
+		Client: diffsync.FuncHandler{func(event diffsync.Event) error {
+			if sessions == nil || event.SID == "" {
+				return q.push(outEvent{Event: event, cid: cid})
+			}
+			sessions.adopt(event.SID)
+			oe, live := resumes.record(event)
+			oe.cid = cid
+			if live == nil {
+				// no connection serves the session right now, the event
+				// will be replayed when the client resumes
+				return nil
+			}
+			return live.push(oe)
+		}}}
+}
+
+func enqueueDropOldest(to_client chan outEvent, oe outEvent) error {
+	for {
+		select {
+		case to_client <- oe:
+			return nil
+		default:
+		}
+		select {
+		case dropped := <-to_client:
+			log.Printf("queue: [%s] full, dropping oldest event for client %v", dropped.cid, dropped.Event)
+			count("queue_drops")
+		default:
+		}
+	}
+}
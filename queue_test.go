@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hiroapp-com/diffsync"
+)
+
+func TestEnqueueDropOldest(t *testing.T) {
+	to_client := make(chan outEvent, 2)
+	for _, name := range []string{"a", "b", "c"} {
+		err := enqueueDropOldest(to_client, outEvent{Event: diffsync.Event{Name: name}})
+		assert(t, err == nil, "enqueue of `%s` failed: %s", name, err)
+	}
+	assert(t, len(to_client) == 2, "queue should hold 2 events, has %d", len(to_client))
+	assert(t, (<-to_client).Name == "b", "oldest event should have been dropped")
+	assert(t, (<-to_client).Name == "c", "newest event should be queued")
+}
+
+func TestCheckQueuePolicy(t *testing.T) {
+	for _, policy := range []string{queueBlock, queueDropOldest, queueDisconnect} {
+		assert(t, checkQueuePolicy(policy) == nil, "policy `%s` should be valid", policy)
+	}
+	assert(t, checkQueuePolicy("drop-newest") != nil, "unknown policy should be rejected")
+}
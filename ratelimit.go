@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit allows Rate events per second with bursts of up to Burst events.
+type rateLimit struct {
+	Rate, Burst float64
+}
+
+// rateLimits maps event names to their limit. The limit for "*" applies to
+// all events without a limit of their own.
+type rateLimits map[string]rateLimit
+
+// parseRateLimits parses specs like "*=20:40,session-create=0.5:3", i.e. a
+// comma separated list of name=rate:burst. burst defaults to rate, but at
+// least 1.
+func parseRateLimits(spec string) (rateLimits, error) {
+	limits := rateLimits{}
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("ratelimit: invalid limit `%s`, expected name=rate:burst", part)
+		}
+		rb := strings.SplitN(kv[1], ":", 2)
+		rate, err := strconv.ParseFloat(rb[0], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("ratelimit: invalid rate in `%s`", part)
+		}
+		// a bucket must hold at least one token, or the event could never
+		// pass
+		burst := math.Max(rate, 1)
+		if len(rb) == 2 {
+			if burst, err = strconv.ParseFloat(rb[1], 64); err != nil || burst < 1 {
+				return nil, fmt.Errorf("ratelimit: invalid burst in `%s`", part)
+			}
+		}
+		limits[strings.TrimSpace(kv[0])] = rateLimit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+func (limits rateLimits) get(name string) (rateLimit, bool) {
+	if l, ok := limits[name]; ok {
+		return l, true
+	}
+	l, ok := limits["*"]
+	return l, ok
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(l rateLimit, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > l.Burst {
+		b.tokens = l.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter enforces rateLimits with one bucket per event name.
+type rateLimiter struct {
+	limits   rateLimits
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	lastSeen time.Time
+}
+
+func newRateLimiter(limits rateLimits) *rateLimiter {
+	return &rateLimiter{limits: limits, buckets: map[string]*bucket{}}
+}
+
+// Allow reports whether an event with the given name may pass.
+func (rl *rateLimiter) Allow(name string) bool {
+	l, ok := rl.limits.get(name)
+	if !ok {
+		return true
+	}
+	if _, own := rl.limits[name]; !own {
+		// all events without own limit share a bucket
+		name = "*"
+	}
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.lastSeen = now
+	b, ok := rl.buckets[name]
+	if !ok {
+		b = &bucket{tokens: l.Burst, last: now}
+		rl.buckets[name] = b
+	}
+	return b.take(l, now)
+}
+
+// ipRateLimiter keeps a rateLimiter per remote IP. Limiters which have been
+// idle for a while are forgotten.
+type ipRateLimiter struct {
+	limits    rateLimits
+	mu        sync.Mutex
+	byIP      map[string]*rateLimiter
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(limits rateLimits) *ipRateLimiter {
+	return &ipRateLimiter{limits: limits, byIP: map[string]*rateLimiter{}, lastSweep: time.Now()}
+}
+
+func (l *ipRateLimiter) Allow(ip, name string) bool {
+	l.mu.Lock()
+	if time.Since(l.lastSweep) > time.Minute {
+		l.sweep(10 * time.Minute)
+	}
+	rl, ok := l.byIP[ip]
+	if !ok {
+		rl = newRateLimiter(l.limits)
+		l.byIP[ip] = rl
+	}
+	l.mu.Unlock()
+	return rl.Allow(name)
+}
+
+func (l *ipRateLimiter) sweep(idle time.Duration) {
+	now := time.Now()
+	for ip, rl := range l.byIP {
+		rl.mu.Lock()
+		if now.Sub(rl.lastSeen) > idle {
+			delete(l.byIP, ip)
+		}
+		rl.mu.Unlock()
+	}
+	l.lastSweep = now
+}
+
+// clientLimiter is used by a single connection and enforces both the
+// per-connection and the per-IP limits.
+type clientLimiter struct {
+	ip   string
+	conn *rateLimiter
+	ips  *ipRateLimiter
+}
+
+func newClientLimiter(r *http.Request) *clientLimiter {
+	return &clientLimiter{ip: clientIP(r), conn: newRateLimiter(connLimits), ips: ipLimiter}
+}
+
+func (cl *clientLimiter) Allow(name string) bool {
+	if !cl.conn.Allow(name) || !cl.ips.Allow(cl.ip, name) {
+		count("ratelimit_throttled")
+		return false
+	}
+	return true
+}
+
+// tooManyRateViolations reports whether a client which got throttled n
+// times should be disconnected.
+func tooManyRateViolations(n int) bool {
+	return *rateMaxViolations > 0 && n > *rateMaxViolations
+}
+
+var (
+	connLimits     = rateLimits{}
+	ipLimiter      = newIPRateLimiter(rateLimits{})
+	trustedProxies = []*net.IPNet{}
+)
+
+// setupRateLimits applies the -rate_* and -trusted_proxies flags.
+func setupRateLimits() (err error) {
+	if connLimits, err = parseRateLimits(*rateConn); err != nil {
+		return err
+	}
+	ipLimits, err := parseRateLimits(*rateIP)
+	if err != nil {
+		return err
+	}
+	ipLimiter = newIPRateLimiter(ipLimits)
+	for _, s := range strings.Split(*trustedProxiesSpec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy `%s`: %s", s, err)
+		}
+		trustedProxies = append(trustedProxies, ipnet)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for i := range trustedProxies {
+		if trustedProxies[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// viaUnixSocket reports whether r came in on a unix socket listener. Its
+// peers have no address, but are trusted like proxies: the socket's mode
+// and owner decide who may connect.
+func viaUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// clientIP returns the IP of the client which sent r. X-Forwarded-For is
+// only honored if the request comes from a trusted proxy or over a unix
+// socket, in which case the right-most address which isn't a trusted proxy
+// itself is used.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !viaUnixSocket(r) {
+		ip := net.ParseIP(host)
+		if ip == nil || !isTrustedProxy(ip) {
+			return host
+		}
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("*=20:40, session-create=0.5:3,token-consume=2,res-sync=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, limits["*"] == rateLimit{20, 40}, "unexpected default limit %v", limits["*"])
+	assert(t, limits["session-create"] == rateLimit{0.5, 3}, "unexpected session-create limit %v", limits["session-create"])
+	assert(t, limits["token-consume"] == rateLimit{2, 2}, "burst should default to rate, got %v", limits["token-consume"])
+	assert(t, limits["res-sync"] == rateLimit{0.5, 1}, "burst should default to at least 1, got %v", limits["res-sync"])
+	rl := newRateLimiter(limits)
+	assert(t, rl.Allow("res-sync"), "events with a rate below 1 should not be throttled forever")
+	for _, spec := range []string{"session-create", "*=fast", "*=0:10", "*=1:0"} {
+		_, err := parseRateLimits(spec)
+		assert(t, err != nil, "spec `%s` should be invalid", spec)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(rateLimits{"*": {Rate: 0.001, Burst: 3}, "session-create": {Rate: 0.001, Burst: 1}})
+	assert(t, rl.Allow("session-create"), "first session-create should pass")
+	assert(t, !rl.Allow("session-create"), "second session-create should be throttled")
+	for i := 0; i < 3; i++ {
+		assert(t, rl.Allow("res-sync"), "res-sync %d within burst should pass", i)
+	}
+	assert(t, !rl.Allow("client-ehlo"), "events without own limit should share the default bucket")
+
+	unlimited := newRateLimiter(rateLimits{"session-create": {Rate: 0.001, Burst: 1}})
+	for i := 0; i < 100; i++ {
+		assert(t, unlimited.Allow("res-sync"), "events without any limit should always pass")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	_, nginx, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{nginx}
+
+	cases := []struct{ remote, xff, expected string }{
+		{"203.0.113.9:5555", "", "203.0.113.9"},
+		{"203.0.113.9:5555", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.2:5555", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.2:5555", "192.0.2.7, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"10.0.0.2:5555", "", "10.0.0.2"},
+	}
+	for _, c := range cases {
+		r := &http.Request{RemoteAddr: c.remote, Header: http.Header{}}
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		ip := clientIP(r)
+		assert(t, ip == c.expected, "clientIP(%s, XFF %q) = %s, expected %s", c.remote, c.xff, ip, c.expected)
+	}
+
+	// peers on unix sockets have no address and count as proxies
+	sock := &net.UnixAddr{Name: "/run/hync.sock", Net: "unix"}
+	r := (&http.Request{RemoteAddr: "@", Header: http.Header{}}).WithContext(context.WithValue(context.Background(), http.LocalAddrContextKey, sock))
+	r.Header.Set("X-Forwarded-For", "192.0.2.7, 198.51.100.1")
+	assert(t, clientIP(r) == "198.51.100.1", "X-Forwarded-For not honored on unix socket: %s", clientIP(r))
+}
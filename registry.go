@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connInfo describes a live client connection. It is registered in the
+// registry for as long as the connection is open.
+type connInfo struct {
+	ID          string
+	Transport   string
+	RemoteAddr  string
+	UserAgent   string
+	ConnectedAt time.Time
+	// Identity is nil for anonymous clients, see Authenticator
+	Identity *Identity
+	// wire is nil for transports without access to the raw connection
+	wire *countingConn
+
+	bytesIn, bytesOut, eventsIn, eventsOut int64
+	// last measured round-trip time
+	rtt int64
+	// time of the last event from the client (unix nanos) and the max.
+	// lifetime of the connection (0: unlimited), see expired
+	lastActive  int64
+	maxLifetime time.Duration
+
+	mu   sync.Mutex
+	sids map[string]bool
+
+	once   sync.Once
+	kicked chan struct{}
+	code   int
+	reason string
+}
+
+func newConnInfo(transport, remoteAddr, userAgent string) *connInfo {
+	now := time.Now()
+	return &connInfo{
+		ID:          randomID(),
+		Transport:   transport,
+		RemoteAddr:  remoteAddr,
+		UserAgent:   userAgent,
+		ConnectedAt: now,
+		lastActive:  now.UnixNano(),
+		maxLifetime: lifetime(),
+		sids:        map[string]bool{},
+		kicked:      make(chan struct{}),
+	}
+}
+
+func (c *connInfo) received(sid string, n int) {
+	atomic.AddInt64(&c.eventsIn, 1)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	if sid == "" {
+		return
+	}
+	c.mu.Lock()
+	c.sids[sid] = true
+	c.mu.Unlock()
+}
+
+func (c *connInfo) sent(events, n int) {
+	atomic.AddInt64(&c.eventsOut, int64(events))
+	atomic.AddInt64(&c.bytesOut, int64(n))
+}
+
+func (c *connInfo) hasSID(sid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sids[sid]
+}
+
+// kick asks the connection to close with the given (WebSocket) close code
+// and reason. Only the first call has an effect.
+func (c *connInfo) kick(code int, reason string) {
+	c.once.Do(func() {
+		c.code, c.reason = code, reason
+		close(c.kicked)
+	})
+}
+
+// connStatus is the JSON representation of a connInfo.
+type connStatus struct {
+	ID          string    `json:"id"`
+	Transport   string    `json:"transport"`
+	RemoteAddr  string    `json:"remote_addr"`
+	UserAgent   string    `json:"user_agent"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Identity    *Identity `json:"identity,omitempty"`
+	SIDs        []string  `json:"sids"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	WireIn      int64     `json:"wire_bytes_in,omitempty"`
+	WireOut     int64     `json:"wire_bytes_out,omitempty"`
+	EventsIn    int64     `json:"events_in"`
+	EventsOut   int64     `json:"events_out"`
+	RTT         float64   `json:"rtt_ms,omitempty"`
+}
+
+func (c *connInfo) status() connStatus {
+	st := connStatus{
+		ID:          c.ID,
+		Transport:   c.Transport,
+		RemoteAddr:  c.RemoteAddr,
+		UserAgent:   c.UserAgent,
+		ConnectedAt: c.ConnectedAt,
+		Identity:    c.Identity,
+		SIDs:        []string{},
+		BytesIn:     atomic.LoadInt64(&c.bytesIn),
+		BytesOut:    atomic.LoadInt64(&c.bytesOut),
+		EventsIn:    atomic.LoadInt64(&c.eventsIn),
+		EventsOut:   atomic.LoadInt64(&c.eventsOut),
+		RTT:         float64(atomic.LoadInt64(&c.rtt)) / float64(time.Millisecond),
+	}
+	if c.wire != nil {
+		st.WireIn, st.WireOut = c.wire.BytesRead(), c.wire.BytesWritten()
+	}
+	c.mu.Lock()
+	for sid := range c.sids {
+		st.SIDs = append(st.SIDs, sid)
+	}
+	c.mu.Unlock()
+	sort.Strings(st.SIDs)
+	return st
+}
+
+// Registry keeps track of all live client connections.
+type Registry struct {
+	mu    sync.RWMutex
+	conns map[string]*connInfo
+}
+
+var registry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{conns: map[string]*connInfo{}}
+}
+
+func (reg *Registry) Add(c *connInfo) {
+	reg.mu.Lock()
+	reg.conns[c.ID] = c
+	reg.mu.Unlock()
+}
+
+func (reg *Registry) Remove(c *connInfo) {
+	reg.mu.Lock()
+	delete(reg.conns, c.ID)
+	reg.mu.Unlock()
+}
+
+func (reg *Registry) Len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return len(reg.conns)
+}
+
+// List returns the status of all connections, oldest first.
+func (reg *Registry) List() []connStatus {
+	reg.mu.RLock()
+	list := make([]connStatus, 0, len(reg.conns))
+	for _, c := range reg.conns {
+		list = append(list, c.status())
+	}
+	reg.mu.RUnlock()
+	sort.Sort(byConnectedAt(list))
+	return list
+}
+
+// Find returns all connections with the given connection-id, or which
+// have seen the given sid.
+func (reg *Registry) Find(id, sid string) []*connInfo {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	found := []*connInfo{}
+	for _, c := range reg.conns {
+		if (id != "" && c.ID == id) || (sid != "" && c.hasSID(sid)) {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+type byConnectedAt []connStatus
+
+func (l byConnectedAt) Len() int           { return len(l) }
+func (l byConnectedAt) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byConnectedAt) Less(i, j int) bool { return l[i].ConnectedAt.Before(l[j].ConnectedAt) }
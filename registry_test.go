@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRegistryFind(t *testing.T) {
+	reg := NewRegistry()
+	a := newConnInfo("ws", "10.0.0.1:1234", "test")
+	b := newConnInfo("sse", "10.0.0.2:1234", "test")
+	reg.Add(a)
+	reg.Add(b)
+	a.received("sid-a", 10)
+	a.received("", 10)
+	b.received("sid-b", 10)
+
+	found := reg.Find(a.ID, "")
+	assert(t, len(found) == 1 && found[0] == a, "lookup by connection-id failed")
+	found = reg.Find("", "sid-b")
+	assert(t, len(found) == 1 && found[0] == b, "lookup by sid failed")
+	assert(t, len(reg.Find("", "unknown")) == 0, "unknown sid should not match")
+
+	st := a.status()
+	assert(t, st.EventsIn == 2 && st.BytesIn == 20, "unexpected counters %#v", st)
+	assert(t, len(st.SIDs) == 1 && st.SIDs[0] == "sid-a", "unexpected sids %v", st.SIDs)
+
+	reg.Remove(a)
+	assert(t, reg.Len() == 1, "expected 1 connection after remove, got %d", reg.Len())
+}
+
+func TestConnInfoKick(t *testing.T) {
+	c := newConnInfo("ws", "10.0.0.1:1234", "test")
+	c.kick(4001, "resync required")
+	c.kick(1008, "closed by admin")
+	<-c.kicked
+	assert(t, c.code == 4001 && c.reason == "resync required", "first kick should win, got %d %s", c.code, c.reason)
+}
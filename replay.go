@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+	"github.com/hiroapp-com/hync/comm"
+)
+
+// `hync replay` replays traffic captured by hync (-capture_file), to
+// reproduce the exact sequence of events a client sent:
+//
+//	HYNC_DB_HOST=postgres://hiro@localhost/scratch hync replay capture.log capture.log.1
+//
+// By default, the capture is replayed against a fresh hync started in the
+// same process, with the settings of hync (-config, environment) and a log
+// comm handler. diffsync has no in-memory store, so -db_host must point to
+// a scratch database set up as described in the readme, never to
+// production. With -url, it is replayed against a running hync instead.
+//
+// Every captured connection is replayed on its own WebSocket connection
+// with the original route, subprotocol and timing (see -speed); the
+// captured frames are sent in the captured codec. Redacted tokens are
+// replaced by fresh anon tokens and captured sids by the ones the target
+// hands out. When done, the names of the events sent by the target are
+// compared with the captured ones and the differences reported as JSON.
+//
+// Replays are only faithful within these limits:
+//
+//   - sids can only be mapped if the capture holds the session-create
+//     which handed them out. Connections captured because of -capture_sids
+//     start after that, so their sessions are unknown to the target and
+//     the replay mostly yields errors.
+//   - Messages for sids which are created in the capture wait up to -wait
+//     for the target's session-create; other sids are sent unchanged.
+//   - The captured tokens are redacted, so every token is replaced by an
+//     anon token: a token-consume of e.g. an invite or login token consumes
+//     an anon token in the replay, and its outcome differs.
+//   - Malformed frames are captured only as fingerprint (length and hash),
+//     which is replayed instead; the target rejects it like the original.
+
+// replayOptions are the flags of `hync replay`.
+type replayOptions struct {
+	url   string
+	speed float64
+	conn  string
+	wait  time.Duration
+}
+
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	opts := replayOptions{}
+	fs.StringVar(&opts.url, "url", "", "base URL of a running hync to replay against (default: a fresh hync in this process, using -db_host)")
+	fs.Float64Var(&opts.speed, "speed", 1, "replay speed factor; 0 sends frames as fast as possible")
+	fs.StringVar(&opts.conn, "conn", "", "only replay the connection with this id")
+	fs.DurationVar(&opts.wait, "wait", 3*time.Second, "how long to wait for replies after the last frame and for sids created in the capture to be mapped")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hync replay [flags] capture-file...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	records, err := readCapture(fs.Args())
+	if err != nil {
+		log.Println("replay:", err)
+		return 1
+	}
+	if opts.url == "" {
+		if err := loadConfig(flag.CommandLine, *configFile, os.Environ()); err != nil {
+			log.Println("replay:", err)
+			return 1
+		}
+		ts, stop, err := replayTarget(*dbHost)
+		if err != nil {
+			log.Println("replay:", err)
+			return 1
+		}
+		defer stop()
+		opts.url = ts.URL
+	}
+	rep := replay(records, opts)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(rep)
+	if len(rep.Mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayTarget starts a hync serving the WebSocket endpoints and
+// /anontoken, backed by the database dsn.
+func replayTarget(dsn string) (*httptest.Server, func(), error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := diffsync.NewServer(db, comm.Handler(comm.NewLogHandler()))
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	s.Store.Mount("note", diffsync.NewNoteSQLBackend(db))
+	s.Store.Mount("folio", diffsync.NewFolioSQLBackend(db))
+	s.Store.Mount("profile", diffsync.NewProfileSQLBackend(db))
+	s.Run()
+	origins, err := NewOriginChecker(OriginPolicy{AllowMissing: true})
+	if err != nil {
+		s.Stop()
+		db.Close()
+		return nil, nil, err
+	}
+	h := NewWsHandler(s, origins, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/anontoken", anonTokenHandler(s))
+	mux.Handle("/0/ws", h)
+	mux.Handle("/1/ws", h)
+	ts := httptest.NewServer(mux)
+	return ts, func() {
+		ts.Close()
+		s.Stop()
+		db.Close()
+	}, nil
+}
+
+// replayMsg holds the fields of a message the replay needs to look at.
+type replayMsg struct {
+	Name    string          `json:"name"`
+	SID     string          `json:"sid"`
+	Tag     string          `json:"tag"`
+	Session json.RawMessage `json:"session"`
+}
+
+// sidMap maps captured sids to the sids of the replay.
+type sidMap struct {
+	mu sync.Mutex
+	m  map[string]string
+	// pending maps captured session-creates (connection and tag) to the
+	// captured sid; tags are only unique within a connection
+	pending map[[2]string]string
+	wait    time.Duration
+}
+
+func newSIDMap(wait time.Duration) *sidMap {
+	return &sidMap{m: map[string]string{}, pending: map[[2]string]string{}, wait: wait}
+}
+
+// expect records that the session-create with tag on connection conn
+// handed out sid in the capture.
+func (sm *sidMap) expect(conn, tag, sid string) {
+	sm.mu.Lock()
+	sm.pending[[2]string{conn, tag}] = sid
+	sm.mu.Unlock()
+}
+
+// created reports whether the capture holds the session-create of sid.
+func (sm *sidMap) created(sid string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, captured := range sm.pending {
+		if captured == sid {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup waits up to wait for sid to be mapped; sids which are not created
+// in the capture are kept right away.
+func (sm *sidMap) lookup(sid string) string {
+	if sid == "" || !sm.created(sid) {
+		return sid
+	}
+	deadline := time.Now().Add(sm.wait)
+	for {
+		sm.mu.Lock()
+		mapped, ok := sm.m[sid]
+		sm.mu.Unlock()
+		if ok {
+			return mapped
+		}
+		if time.Now().After(deadline) {
+			return sid
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// learn maps the captured sid of the session-create with tag on connection
+// conn to sid.
+func (sm *sidMap) learn(conn, tag, sid string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if old, ok := sm.pending[[2]string{conn, tag}]; ok {
+		sm.m[old] = sid
+	}
+}
+
+// replayConn is the replay of a captured connection.
+type replayConn struct {
+	id       string
+	codec    Codec
+	ws       *websocket.Conn
+	captured []string
+	mu       sync.Mutex
+	replayed []string
+}
+
+// replayReport is the outcome of a replay.
+type replayReport struct {
+	Conns      int        `json:"conns"`
+	FramesSent int        `json:"frames_sent"`
+	Mismatches []mismatch `json:"mismatches"`
+}
+
+// replay replays records against the hync at opts.url.
+func replay(records []captureRecord, opts replayOptions) replayReport {
+	sids := newSIDMap(opts.wait)
+	conns := map[string]*replayConn{}
+	conn := func(rec captureRecord) *replayConn {
+		proto := protocols[rec.Version]
+		if proto == nil {
+			proto = protocols[currentProtocol]
+		}
+		c := conns[rec.Conn]
+		if c == nil {
+			c = &replayConn{id: rec.Conn, codec: newVersionedCodec(proto, "json")}
+			conns[rec.Conn] = c
+		}
+		if rec.Kind == "open" && codecs[rec.Codec] != nil {
+			c.codec = newVersionedCodec(proto, rec.Codec)
+		}
+		return c
+	}
+	// learn the captured sids and outgoing event sequences up front
+	for _, rec := range records {
+		c := conn(rec)
+		if rec.Kind != "out" {
+			continue
+		}
+		for _, m := range parseReplayMsgs(rec.Msgs) {
+			c.captured = append(c.captured, m.Name)
+			if sid := sessionSID(m); sid != "" {
+				sids.expect(rec.Conn, m.Tag, sid)
+			}
+		}
+	}
+
+	var first, began time.Time
+	frames := 0
+	for _, rec := range records {
+		if opts.conn != "" && rec.Conn != opts.conn {
+			continue
+		}
+		if first.IsZero() {
+			first, began = rec.Time, time.Now()
+		}
+		if opts.speed > 0 {
+			due := time.Duration(float64(rec.Time.Sub(first)) / opts.speed)
+			time.Sleep(due - time.Since(began))
+		}
+		c := conn(rec)
+		switch rec.Kind {
+		case "open":
+			if err := c.dial(opts.url, rec, sids); err != nil {
+				log.Printf("replay: cannot open connection %s: %s", rec.Conn, err)
+			}
+		case "in":
+			if c.ws == nil {
+				if err := c.dial(opts.url, rec, sids); err != nil {
+					log.Printf("replay: cannot open connection %s: %s", rec.Conn, err)
+					continue
+				}
+			}
+			if err := c.send(opts.url, rec, sids); err != nil {
+				log.Printf("replay: cannot send frame of %s: %s", rec.Conn, err)
+			}
+			frames++
+		case "close":
+			if ws := c.ws; ws != nil {
+				time.AfterFunc(opts.wait, func() { ws.Close() })
+			}
+		}
+	}
+	time.Sleep(opts.wait)
+
+	rep := replayReport{FramesSent: frames, Mismatches: []mismatch{}}
+	for _, c := range conns {
+		if opts.conn != "" && c.id != opts.conn {
+			continue
+		}
+		rep.Conns++
+		if m := c.mismatch(); m != nil {
+			rep.Mismatches = append(rep.Mismatches, *m)
+		}
+	}
+	sort.Slice(rep.Mismatches, func(i, j int) bool { return rep.Mismatches[i].Conn < rep.Mismatches[j].Conn })
+	return rep
+}
+
+func (c *replayConn) dial(baseURL string, rec captureRecord, sids *sidMap) error {
+	path := rec.Path
+	if path == "" {
+		path = fmt.Sprintf("/%d/ws", rec.Version)
+	}
+	codecName := rec.Codec
+	if codecName == "" {
+		codecName = "json"
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol(rec.Version, codecName)}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(strings.TrimRight(baseURL, "/"), "http")+path, nil)
+	if err != nil {
+		return err
+	}
+	c.ws = ws
+	go func() {
+		for {
+			_, frame, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, m := range parseReplayMsgs(c.toJSON(frame)) {
+				c.mu.Lock()
+				c.replayed = append(c.replayed, m.Name)
+				c.mu.Unlock()
+				if sid := sessionSID(m); sid != "" {
+					sids.learn(c.id, m.Tag, sid)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// toJSON decodes a frame into JSON messages.
+func (c *replayConn) toJSON(frame []byte) []json.RawMessage {
+	msgs, err := c.codec.Demux(frame)
+	if err != nil {
+		return nil
+	}
+	jsonMsgs := []json.RawMessage{}
+	for _, msg := range msgs {
+		if jsonMsg, err := c.codec.ToJSON(msg); err == nil {
+			jsonMsgs = append(jsonMsgs, jsonMsg)
+		}
+	}
+	return jsonMsgs
+}
+
+// send sends a captured frame, with tokens and sids rewritten. Frames
+// without messages to rewrite are sent as captured.
+func (c *replayConn) send(baseURL string, rec captureRecord, sids *sidMap) error {
+	if rec.Frame == nil {
+		// malformed frames were captured as their fingerprint, which the
+		// target rejects like the original
+		frame, err := json.Marshal(rec.Msgs)
+		if err != nil {
+			return err
+		}
+		return c.ws.WriteMessage(websocket.TextMessage, frame)
+	}
+	msgs, err := c.codec.Demux(rec.Frame)
+	if err != nil {
+		return c.ws.WriteMessage(c.codec.FrameType(), rec.Frame)
+	}
+	rewritten := false
+	for i := range msgs {
+		jsonMsg, err := c.codec.ToJSON(msgs[i])
+		if err != nil {
+			continue
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(jsonMsg, &m); err != nil {
+			continue
+		}
+		changed := false
+		if sid, ok := m["sid"].(string); ok {
+			if mapped := sids.lookup(sid); mapped != sid {
+				m["sid"], changed = mapped, true
+			}
+		}
+		if m["token"] == redacted {
+			token, err := replayToken(baseURL)
+			if err != nil {
+				return err
+			}
+			m["token"], changed = token, true
+		}
+		if !changed {
+			continue
+		}
+		jsonMsg, _ = json.Marshal(m)
+		if msg, err := c.codec.FromJSON(jsonMsg); err == nil {
+			msgs[i], rewritten = msg, true
+		}
+	}
+	frame := rec.Frame
+	if rewritten {
+		if frame, err = c.codec.Mux(msgs); err != nil {
+			return err
+		}
+	}
+	return c.ws.WriteMessage(c.codec.FrameType(), frame)
+}
+
+// mismatch returns the first difference between the captured and replayed
+// event names, or nil.
+func (c *replayConn) mismatch() *mismatch {
+	c.mu.Lock()
+	replayed := c.replayed
+	c.mu.Unlock()
+	for i := 0; i < len(c.captured) || i < len(replayed); i++ {
+		if i < len(c.captured) && i < len(replayed) && c.captured[i] == replayed[i] {
+			continue
+		}
+		return &mismatch{Conn: c.id, Index: i, Captured: tail(c.captured, i), Replayed: tail(replayed, i)}
+	}
+	return nil
+}
+
+// readCapture reads the records of capture files, ordered by time.
+func readCapture(paths []string) ([]captureRecord, error) {
+	records := []captureRecord{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64<<20)
+		for scanner.Scan() {
+			rec := captureRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+			records = append(records, rec)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+func parseReplayMsgs(raw []json.RawMessage) []replayMsg {
+	msgs := []replayMsg{}
+	for i := range raw {
+		m := replayMsg{}
+		if json.Unmarshal(raw[i], &m) == nil {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+func sessionSID(m replayMsg) string {
+	if m.Name != "session-create" || m.Session == nil {
+		return ""
+	}
+	sess := struct {
+		SID string `json:"sid"`
+	}{}
+	json.Unmarshal(m.Session, &sess)
+	return sess.SID
+}
+
+// replayToken fetches an anon token from the target.
+func replayToken(baseURL string) (string, error) {
+	resp, err := http.Get(strings.TrimRight(baseURL, "/") + "/anontoken")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || len(token) == 0 {
+		return "", fmt.Errorf("GET /anontoken: %s", resp.Status)
+	}
+	return string(token), nil
+}
+
+// mismatch is the first difference between the captured and replayed
+// event names of a connection.
+type mismatch struct {
+	Conn     string   `json:"conn"`
+	Index    int      `json:"index"`
+	Captured []string `json:"captured"`
+	Replayed []string `json:"replayed"`
+}
+
+// tail returns up to 5 names starting at i.
+func tail(names []string, i int) []string {
+	if i >= len(names) {
+		return []string{}
+	}
+	if len(names) > i+5 {
+		return names[i : i+5]
+	}
+	return names[i:]
+}
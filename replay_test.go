@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReplaySIDMap(t *testing.T) {
+	sids := newSIDMap(50 * time.Millisecond)
+	// tags repeat across connections
+	sids.expect("c1", "client01", "s1")
+	sids.expect("c2", "client01", "s2")
+	sids.learn("c2", "client01", "n2")
+	assert(t, sids.lookup("s2") == "n2", "sid should be mapped per connection")
+	start := time.Now()
+	assert(t, sids.lookup("s1") == "s1", "unmapped sid should be kept")
+	assert(t, time.Since(start) >= 50*time.Millisecond, "lookup should wait for sids created in the capture")
+	start = time.Now()
+	assert(t, sids.lookup("other") == "other" && time.Since(start) < 50*time.Millisecond, "sids not created in the capture should be kept right away")
+}
+
+// encodeFrame encodes JSON messages as frame of codec.
+func encodeFrame(t *testing.T, c Codec, jsonMsgs ...string) []byte {
+	msgs := [][]byte{}
+	for _, jsonMsg := range jsonMsgs {
+		msg, err := c.FromJSON([]byte(jsonMsg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	frame, err := c.Mux(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestReplay(t *testing.T) {
+	c := newVersionedCodec(protocols[0], "msgpack")
+	created := `{"name":"session-create","sid":"","tag":"t","session":{"sid":"%s"}}`
+	// the target answers session-create with a sid of its own and passes
+	// on the other frames it receives
+	received := make(chan []byte, 8)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := websocket.Upgrader{Subprotocols: []string{subprotocol(0, "msgpack")}}
+		ws, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		assert(t, ws.Subprotocol() == subprotocol(0, "msgpack"), "captured codec should be negotiated, got %q", ws.Subprotocol())
+		for i := 0; ; i++ {
+			_, frame, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				ws.WriteMessage(c.FrameType(), encodeFrame(t, c, fmt.Sprintf(created, "n1")))
+				continue
+			}
+			received <- frame
+		}
+	}))
+	defer ts.Close()
+
+	at := time.Now()
+	records := []captureRecord{
+		{Time: at, Conn: "c1", Kind: "open", Path: "/0/ws", Codec: "msgpack"},
+		{Time: at, Conn: "c1", Kind: "in", Frame: encodeFrame(t, c, `{"name":"session-create","tag":"t"}`)},
+		{Time: at, Conn: "c1", Kind: "out", Msgs: []json.RawMessage{json.RawMessage(fmt.Sprintf(created, "s1"))}},
+		{Time: at, Conn: "c1", Kind: "in", Frame: encodeFrame(t, c, `{"name":"client-ehlo","sid":"s1"}`)},
+		{Time: at, Conn: "c1", Kind: "close"},
+	}
+	rep := replay(records, replayOptions{url: ts.URL, wait: 200 * time.Millisecond})
+	assert(t, rep.Conns == 1 && rep.FramesSent == 2 && len(rep.Mismatches) == 0, "unexpected report %+v", rep)
+	select {
+	case frame := <-received:
+		msgs := (&replayConn{codec: c}).toJSON(frame)
+		m := replayMsg{}
+		if assert(t, len(msgs) == 1, "expected a single message, got %d", len(msgs)) {
+			json.Unmarshal(msgs[0], &m)
+			assert(t, m.Name == "client-ehlo" && m.SID == "n1", "captured sid should be replaced by the target's, got %+v", m)
+		}
+	default:
+		t.Fatal("client-ehlo was not replayed")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hiroapp-com/diffsync"
+)
+
+// Clients speaking protocol v1 or later can resume their sessions after
+// losing the connection. Every event sent to such a session carries a
+// sequence number ("seq") and is kept in the session's resume buffer until
+// the client acknowledges it:
+//
+//	{"name": "session-ack", "sid": "...", "seq": 42}
+//
+// After reconnecting, the client asks for the events it missed:
+//
+//	{"name": "session-resume", "sid": "...", "tag": "...", "last_seq": 42}
+//
+// hync replays all buffered events after last_seq and answers with a
+// "session-resume" message with status "ok". If the buffer has overflowed
+// or expired in the meantime, status is "resync-required" and the client
+// has to rebuild its state (e.g. with client-ehlo). A session is served by
+// one connection at a time: while its previous connection is still alive
+// from hync's point of view, status is "busy" and the client should retry
+// later.
+
+// status of a session-resume reply
+const (
+	resumeOK     = "ok"
+	resumeResync = "resync-required"
+	resumeBusy   = "busy"
+)
+
+// sessionBuffer holds the unacknowledged events of a session.
+type sessionBuffer struct {
+	mu     sync.Mutex
+	events []outEvent
+	// nextSeq is the sequence number of the next event; lost is the
+	// highest sequence number which was evicted before being acknowledged
+	nextSeq, lost uint64
+	// live is the queue of the connection currently serving the session
+	live     *clientQueue
+	lastUsed time.Time
+}
+
+type resumeStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*sessionBuffer
+	lastSweep time.Time
+}
+
+var resumes = newResumeStore()
+
+func newResumeStore() *resumeStore {
+	return &resumeStore{sessions: map[string]*sessionBuffer{}, lastSweep: time.Now()}
+}
+
+func (rs *resumeStore) get(sid string, create bool) *sessionBuffer {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if time.Since(rs.lastSweep) > time.Minute {
+		rs.sweep(*resumeTTL)
+	}
+	buf, ok := rs.sessions[sid]
+	if !ok && create {
+		buf = &sessionBuffer{nextSeq: 1, lastUsed: time.Now()}
+		rs.sessions[sid] = buf
+	}
+	return buf
+}
+
+// sweep forgets buffers of sessions which have not been served by any
+// connection for longer than ttl.
+func (rs *resumeStore) sweep(ttl time.Duration) {
+	now := time.Now()
+	for sid, buf := range rs.sessions {
+		buf.mu.Lock()
+		if buf.live == nil && now.Sub(buf.lastUsed) > ttl {
+			delete(rs.sessions, sid)
+			count("resume_expired")
+		}
+		buf.mu.Unlock()
+	}
+	rs.lastSweep = now
+}
+
+// record assigns the next sequence number to event and keeps it in the
+// session's buffer. It returns the queue of the connection currently
+// serving the session, if any.
+func (rs *resumeStore) record(event diffsync.Event) (outEvent, *clientQueue) {
+	buf := rs.get(event.SID, true)
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	oe := outEvent{Event: event, seq: buf.nextSeq}
+	buf.nextSeq++
+	buf.events = append(buf.events, oe)
+	if over := len(buf.events) - *resumeBuffer; over > 0 {
+		buf.lost = buf.events[over-1].seq
+		buf.events = buf.events[over:]
+		stats.Add("resume_overflows", int64(over))
+	}
+	buf.lastUsed = time.Now()
+	return oe, buf.live
+}
+
+// ack drops all events up to seq from the session's buffer.
+func (rs *resumeStore) ack(sid string, seq uint64) {
+	buf := rs.get(sid, false)
+	if buf == nil {
+		return
+	}
+	buf.mu.Lock()
+	i := 0
+	for i < len(buf.events) && buf.events[i].seq <= seq {
+		i++
+	}
+	buf.events = buf.events[i:]
+	buf.mu.Unlock()
+}
+
+// adopt attaches q to the session if hync has not seen it before, i.e. the
+// event for it is the reply to its creation. It reports whether q was
+// attached.
+func (rs *resumeStore) adopt(sid string, q *clientQueue) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if _, ok := rs.sessions[sid]; ok {
+		return false
+	}
+	rs.sessions[sid] = &sessionBuffer{nextSeq: 1, live: q, lastUsed: time.Now()}
+	return true
+}
+
+// claim attaches q to the session unless another connection serves it. It
+// reports whether q serves the session.
+func (rs *resumeStore) claim(sid string, q *clientQueue) bool {
+	buf := rs.get(sid, true)
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	if buf.live != nil && buf.live != q {
+		return false
+	}
+	buf.live, buf.lastUsed = q, time.Now()
+	return true
+}
+
+// attach makes q the queue which serves the session.
+func (rs *resumeStore) attach(sid string, q *clientQueue) {
+	buf := rs.get(sid, true)
+	buf.mu.Lock()
+	buf.live, buf.lastUsed = q, time.Now()
+	buf.mu.Unlock()
+}
+
+// detach is called when the connection of q goes away. Events for the
+// session are buffered until the client resumes.
+func (rs *resumeStore) detach(sid string, q *clientQueue) {
+	buf := rs.get(sid, false)
+	if buf == nil {
+		return
+	}
+	buf.mu.Lock()
+	if buf.live == q {
+		buf.live, buf.lastUsed = nil, time.Now()
+	}
+	buf.mu.Unlock()
+}
+
+// resume replays all events after lastSeq into q, followed by reply, and
+// attaches q to the session. It returns resumeResync if events the client
+// has not seen are lost or cannot be queued; q is attached nevertheless, so
+// that it gets the events of the resync. If another connection serves the
+// session, nothing is replayed and it returns resumeBusy.
+//
+// Events are pushed without holding the session's lock, so record is not
+// blocked by a slow client. Events recorded meanwhile are replayed as well,
+// q is attached once it has caught up.
+func (rs *resumeStore) resume(sid string, lastSeq uint64, q *clientQueue, reply func(replayed int, status string) []byte) string {
+	buf := rs.get(sid, false)
+	if buf == nil {
+		// unknown or expired session
+		if !rs.claim(sid, q) {
+			q.push(outEvent{raw: reply(0, resumeBusy)})
+			return resumeBusy
+		}
+		q.push(outEvent{raw: reply(0, resumeResync)})
+		return resumeResync
+	}
+	replayed, sent := 0, lastSeq
+	for {
+		buf.mu.Lock()
+		buf.lastUsed = time.Now()
+		if buf.live != nil && buf.live != q {
+			buf.mu.Unlock()
+			q.push(outEvent{raw: reply(0, resumeBusy)})
+			return resumeBusy
+		}
+		if sent < buf.lost || sent >= buf.nextSeq {
+			buf.live = q
+			buf.mu.Unlock()
+			q.push(outEvent{raw: reply(0, resumeResync)})
+			return resumeResync
+		}
+		missed := []outEvent{}
+		for _, oe := range buf.events {
+			if oe.seq > sent {
+				missed = append(missed, oe)
+			}
+		}
+		if len(missed) == 0 {
+			buf.live = q
+			buf.mu.Unlock()
+			break
+		}
+		buf.mu.Unlock()
+		for _, oe := range missed {
+			if err := q.push(oe); err != nil {
+				log.Println("resume: could not replay event, resync required:", err)
+				rs.claim(sid, q)
+				q.push(outEvent{raw: reply(0, resumeResync)})
+				return resumeResync
+			}
+			sent = oe.seq
+			replayed++
+		}
+	}
+	q.push(outEvent{raw: reply(replayed, resumeOK)})
+	return resumeOK
+}
+
+// sessionSet is the set of sessions served by a single connection with
+// outbound queue q.
+type sessionSet struct {
+	mu     sync.Mutex
+	q      *clientQueue
+	sids   map[string]bool
+	closed bool
+}
+
+func newSessionSet(q *clientQueue) *sessionSet {
+	return &sessionSet{q: q, sids: map[string]bool{}}
+}
+
+// attach makes the connection serve sid, unless another connection serves
+// it. It reports whether the connection serves sid.
+func (ss *sessionSet) attach(sid string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sid == "" || ss.closed {
+		return false
+	}
+	if ss.sids[sid] {
+		return true
+	}
+	if !resumes.claim(sid, ss.q) {
+		return false
+	}
+	ss.sids[sid] = true
+	return true
+}
+
+// adopt makes the connection serve sid if the session is new, see
+// resumeStore.adopt.
+func (ss *sessionSet) adopt(sid string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sid == "" || ss.closed || ss.sids[sid] {
+		return
+	}
+	if resumes.adopt(sid, ss.q) {
+		ss.sids[sid] = true
+	}
+}
+
+// control handles a control message; the connection serves the session
+// afterwards, unless another connection serves it.
+func (ss *sessionSet) control(ctrl controlMsg) {
+	if ctrl.Name == "session-ack" {
+		if ss.attach(ctrl.SID) {
+			resumes.ack(ctrl.SID, ctrl.Seq)
+		}
+		return
+	}
+	if handleResume(ctrl, ss.q) == resumeBusy {
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		// resumed while the connection went away
+		resumes.detach(ctrl.SID, ss.q)
+		return
+	}
+	ss.sids[ctrl.SID] = true
+}
+
+// detachAll is called when the connection goes away; its sessions are
+// buffered until the client resumes them.
+func (ss *sessionSet) detachAll() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for sid := range ss.sids {
+		resumes.detach(sid, ss.q)
+	}
+	ss.sids, ss.closed = map[string]bool{}, true
+}
+
+// controlMsg is a message handled by hync itself rather than by diffsync.
+type controlMsg struct {
+	Name    string `json:"name"`
+	SID     string `json:"sid"`
+	Tag     string `json:"tag"`
+	Seq     uint64 `json:"seq"`
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// resumeReply answers a session-resume request.
+type resumeReply struct {
+	Name     string `json:"name"`
+	SID      string `json:"sid"`
+	Tag      string `json:"tag"`
+	Status   string `json:"status"`
+	Replayed int    `json:"replayed"`
+}
+
+func parseControl(jsonMsg []byte) (controlMsg, bool) {
+	ctrl := controlMsg{}
+	if err := json.Unmarshal(jsonMsg, &ctrl); err != nil {
+		return ctrl, false
+	}
+	return ctrl, ctrl.Name == "session-resume" || ctrl.Name == "session-ack"
+}
+
+// handleResume handles a session-resume request of a connection with
+// outbound queue q and returns the status of the reply.
+func handleResume(ctrl controlMsg, q *clientQueue) string {
+	status := resumes.resume(ctrl.SID, ctrl.LastSeq, q, func(replayed int, status string) []byte {
+		msg, _ := json.Marshal(resumeReply{Name: "session-resume", SID: ctrl.SID, Tag: ctrl.Tag, Status: status, Replayed: replayed})
+		return msg
+	})
+	switch status {
+	case resumeOK:
+		count("resume_ok")
+	case resumeResync:
+		count("resume_resync_required")
+	case resumeBusy:
+		count("resume_busy")
+	}
+	log.Printf("resume: session `%s` resumed after seq %d: %s", ctrl.SID, ctrl.LastSeq, status)
+	return status
+}
+
+// encodeOut encodes an entry of an outbound queue, adding its sequence
+// number to the message.
+func encodeOut(c Codec, oe outEvent) ([]byte, error) {
+	if oe.raw != nil {
+		return c.FromJSON(oe.raw)
+	}
+	msg, err := c.EventToMsg(oe.Event)
+	if err != nil || oe.seq == 0 {
+		return msg, err
+	}
+	jsonMsg, err := c.ToJSON(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonMsg) < 2 || jsonMsg[0] != '{' {
+		return msg, nil
+	}
+	prefix := `{"seq":` + strconv.FormatUint(oe.seq, 10)
+	if jsonMsg[1] != '}' {
+		prefix += ","
+	}
+	return c.FromJSON(append([]byte(prefix), jsonMsg[1:]...))
+}
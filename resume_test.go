@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroapp-com/diffsync"
+)
+
+func testReply(replayed int, status string) []byte {
+	msg, _ := json.Marshal(map[string]interface{}{"replayed": replayed, "status": status})
+	return msg
+}
+
+func TestResumeReplaysMissedEvents(t *testing.T) {
+	rs := newResumeStore()
+	q := &clientQueue{to_client: make(chan outEvent, 16)}
+	rs.attach("sid", q)
+	for _, name := range []string{"a", "b", "c"} {
+		oe, live := rs.record(diffsync.Event{Name: name, SID: "sid"})
+		assert(t, live == q, "event `%s` should go to the attached queue", name)
+		live.push(oe)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		oe := <-q.to_client
+		assert(t, oe.seq == i, "expected seq %d, got %d", i, oe.seq)
+	}
+	rs.ack("sid", 1)
+	rs.detach("sid", q)
+	oe, live := rs.record(diffsync.Event{Name: "d", SID: "sid"})
+	assert(t, live == nil && oe.seq == 4, "detached session should only buffer events")
+
+	q2 := &clientQueue{to_client: make(chan outEvent, 16)}
+	assert(t, rs.resume("sid", 2, q2, testReply) == resumeOK, "resume after seq 2 should succeed")
+	assert(t, len(q2.to_client) == 3, "expected 2 replayed events and reply, got %d", len(q2.to_client))
+	assert(t, (<-q2.to_client).Name == "c", "event c should be replayed first")
+	assert(t, (<-q2.to_client).Name == "d", "event d should be replayed second")
+	assert(t, (<-q2.to_client).raw != nil, "reply should be last")
+	_, live = rs.record(diffsync.Event{Name: "e", SID: "sid"})
+	assert(t, live == q2, "resumed session should be attached to the new queue")
+}
+
+func TestResumeRequiresResync(t *testing.T) {
+	defer func(n int) { *resumeBuffer = n }(*resumeBuffer)
+	*resumeBuffer = 2
+	rs := newResumeStore()
+	for _, name := range []string{"a", "b", "c"} {
+		rs.record(diffsync.Event{Name: name, SID: "sid"})
+	}
+	q := &clientQueue{to_client: make(chan outEvent, 16)}
+	assert(t, rs.resume("sid", 0, q, testReply) == resumeResync, "events lost to overflow should require resync")
+	assert(t, rs.resume("sid", 1, q, testReply) == resumeOK, "events after the overflow can be replayed")
+	assert(t, rs.resume("sid", 9, q, testReply) == resumeResync, "unknown seq should require resync")
+	assert(t, rs.resume("unknown", 0, q, testReply) == resumeResync, "unknown session should require resync")
+	_, live := rs.record(diffsync.Event{Name: "d", SID: "unknown"})
+	assert(t, live == q, "queue should be attached after a failed resume")
+}
+
+func TestResumeFailedReplay(t *testing.T) {
+	defer func(policy string, timeout time.Duration) {
+		*queuePolicy, *queueTimeout = policy, timeout
+	}(*queuePolicy, *queueTimeout)
+	*queuePolicy, *queueTimeout = queueBlock, 10*time.Millisecond
+	rs := newResumeStore()
+	for _, name := range []string{"a", "b", "c"} {
+		rs.record(diffsync.Event{Name: name, SID: "sid"})
+	}
+
+	// room for a single event, the reply to the resume is dropped as well
+	q := &clientQueue{to_client: make(chan outEvent, 1)}
+	replies := []string{}
+	status := rs.resume("sid", 0, q, func(replayed int, status string) []byte {
+		replies = append(replies, status)
+		return testReply(replayed, status)
+	})
+	assert(t, status == resumeResync && len(replies) == 1 && replies[0] == resumeResync, "events which cannot be replayed should require resync, got %v", replies)
+	_, live := rs.record(diffsync.Event{Name: "d", SID: "sid"})
+	assert(t, live == q, "queue should be attached after a failed replay")
+}
+
+func TestResumeDoesNotBlockRecord(t *testing.T) {
+	rs := newResumeStore()
+	for _, name := range []string{"a", "b"} {
+		rs.record(diffsync.Event{Name: name, SID: "sid"})
+	}
+	q := &clientQueue{to_client: make(chan outEvent)}
+	done := make(chan string)
+	go func() { done <- rs.resume("sid", 0, q, testReply) }()
+	assert(t, (<-q.to_client).Name == "a", "event a should be replayed first")
+
+	// the client is slow, but events can be recorded meanwhile
+	recorded := make(chan *clientQueue)
+	go func() {
+		_, live := rs.record(diffsync.Event{Name: "c", SID: "sid"})
+		recorded <- live
+	}()
+	select {
+	case live := <-recorded:
+		assert(t, live == nil, "queue should not be attached before it has caught up")
+	case <-time.After(time.Second):
+		t.Fatal("record blocked by replay")
+	}
+	names := []string{}
+	for oe := range q.to_client {
+		if oe.raw != nil {
+			break
+		}
+		names = append(names, oe.Name)
+	}
+	assert(t, <-done == resumeOK, "resume should succeed")
+	assert(t, strings.Join(names, ",") == "b,c", "events recorded during the replay should be replayed too, got %v", names)
+}
+
+func TestControlMessages(t *testing.T) {
+	msg, err := encodeOut(codecs["json"], outEvent{seq: 7, raw: []byte(`{"name":"x"}`)})
+	assert(t, err == nil && string(msg) == `{"name":"x"}`, "raw messages are sent as is, got %s (%v)", msg, err)
+	ctrl, ok := parseControl([]byte(`{"name":"session-ack","sid":"s","seq":3}`))
+	assert(t, ok && ctrl.Seq == 3, "session-ack should be parsed as control message")
+	_, ok = parseControl([]byte(`{"name":"session-create"}`))
+	assert(t, !ok, "session-create is no control message")
+}
+
+func TestSessionSetAdoptsNewSessions(t *testing.T) {
+	defer func(rs *resumeStore) { resumes = rs }(resumes)
+	resumes = newResumeStore()
+	q := &clientQueue{to_client: make(chan outEvent, 16)}
+	sessions := newSessionSet(q)
+	other := &clientQueue{to_client: make(chan outEvent, 16)}
+	resumes.attach("taken", other)
+
+	// replies to session-create carry the sid of the new session
+	ctx := clientContext(q, sessions, "cid")
+	ctx.Client.Handle(diffsync.Event{Name: "session-create", SID: "new"})
+	assert(t, len(q.to_client) == 1, "reply for a new session should be delivered")
+	ctx.Client.Handle(diffsync.Event{Name: "res-sync", SID: "taken"})
+	assert(t, len(q.to_client) == 1 && len(other.to_client) == 1, "sessions served by other connections must not be taken over")
+
+	sessions.detachAll()
+	_, live := resumes.record(diffsync.Event{Name: "res-sync", SID: "new"})
+	assert(t, live == nil, "session should be detached with the connection")
+	sessions.attach("late")
+	assert(t, resumes.get("late", false) == nil, "closed set should not attach sessions")
+}
+
+func TestSessionSetOwnership(t *testing.T) {
+	defer func(rs *resumeStore) { resumes = rs }(resumes)
+	resumes = newResumeStore()
+	owner := &clientQueue{to_client: make(chan outEvent, 16)}
+	resumes.attach("sid", owner)
+	resumes.record(diffsync.Event{Name: "res-sync", SID: "sid"})
+
+	q := &clientQueue{to_client: make(chan outEvent, 16)}
+	sessions := newSessionSet(q)
+	assert(t, !sessions.attach("sid"), "events with the sid of a live session must not take it over")
+	sessions.control(controlMsg{Name: "session-ack", SID: "sid", Seq: 1})
+	assert(t, len(resumes.get("sid", false).events) == 1, "only the connection serving a session may acknowledge its events")
+	sessions.control(controlMsg{Name: "session-resume", SID: "sid", Tag: "t"})
+	reply := resumeReply{}
+	json.Unmarshal((<-q.to_client).raw, &reply)
+	assert(t, reply.Status == resumeBusy && len(q.to_client) == 0, "resume of a live session should be answered with busy only, got %+v", reply)
+	_, live := resumes.record(diffsync.Event{Name: "res-sync", SID: "sid"})
+	assert(t, live == owner, "session should still be served by its connection")
+
+	// once the connection has gone away, the session can be resumed
+	resumes.detach("sid", owner)
+	sessions.control(controlMsg{Name: "session-resume", SID: "sid", Tag: "t"})
+	assert(t, len(q.to_client) == 3, "expected 2 replayed events and reply, got %d", len(q.to_client))
+	assert(t, sessions.attach("sid"), "resumed session should be served by the connection")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// retryAfter returns how long a client should wait before reconnecting
+// after a server restart. The random jitter spreads the reconnects of all
+// clients over -restart_jitter, so a rolling deploy doesn't cause a
+// reconnect stampede.
+func retryAfter() time.Duration {
+	d := *restartRetry
+	if *restartJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(*restartJitter)))
+	}
+	return d
+}
+
+// restartReason tells a client on shutdown to reconnect after retry.
+func restartReason(retry time.Duration) string {
+	return fmt.Sprintf("server-restarting, retry after %d ms", retry/time.Millisecond)
+}
+
+// waitDrained waits for wg until ctx expires and reports whether wg
+// finished in time.
+func waitDrained(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// errDraining rejects connections which arrive while shutting down.
+var errDraining = errors.New("server shutting down")
+
+// connGroup tracks the open connections of a transport. Connections are
+// added under the same lock which starts draining, so that none is added
+// while drain waits for them; once draining, new connections are refused.
+type connGroup struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	stop     chan struct{}
+}
+
+func newConnGroup() *connGroup {
+	return &connGroup{stop: make(chan struct{})}
+}
+
+// add registers a new connection, which must call done when it is over.
+// It returns false if the group is draining.
+func (g *connGroup) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.draining {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+func (g *connGroup) done() {
+	g.wg.Done()
+}
+
+// stopping is closed when draining starts.
+func (g *connGroup) stopping() <-chan struct{} {
+	return g.stop
+}
+
+// startDrain tells all connections to finish and refuses new ones.
+func (g *connGroup) startDrain() {
+	g.mu.Lock()
+	if !g.draining {
+		g.draining = true
+		close(g.stop)
+	}
+	g.mu.Unlock()
+}
+
+// drain tells all connections to finish and waits for them until ctx
+// expires. It reports whether they finished in time.
+func (g *connGroup) drain(ctx context.Context) bool {
+	g.startDrain()
+	return waitDrained(ctx, &g.wg)
+}
+
+// wait waits for all connections to finish.
+func (g *connGroup) wait() {
+	g.wg.Wait()
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+)
+
+const maxPostSize = 1 << 20
+
+// SSEHandler is the fallback transport for clients which cannot establish a
+// WebSocket connection. A GET request opens a Server-Sent Events stream; the
+// first event on the stream (named "stream") carries the stream-id. Message
+// lists from the client are then POSTed to the same URL with ?stream=<id>,
+// from the same IP and with the same credentials as the stream. Events are
+// encoded exactly like on the WebSocket transport.
+type SSEHandler struct {
+	srv     *diffsync.Server
+	origins *OriginChecker
+	auth    *Authenticator
+	mu      sync.Mutex
+	streams map[string]*sseStream
+	conns   *connGroup
+}
+
+type sseStream struct {
+	sync.Mutex
+	q *clientQueue
+	// sessions is nil unless the client can resume its sessions
+	sessions    *sessionSet
+	protoErrors int
+	violations  int
+	codec       Codec
+	limiter     *clientLimiter
+	info        *connInfo
+}
+
+func NewSSEHandler(s *diffsync.Server, origins *OriginChecker, auth *Authenticator) *SSEHandler {
+	return &SSEHandler{
+		srv:     s,
+		origins: origins,
+		auth:    auth,
+		streams: map[string]*sseStream{},
+		conns:   newConnGroup(),
+	}
+}
+
+// Stop makes all streams flush their pending events and end with a
+// "restart" event. It waits for the streams to finish until ctx expires.
+func (h *SSEHandler) Stop(ctx context.Context) {
+	log.Println("sse: shutting down streams")
+	if !h.conns.drain(ctx) {
+		log.Println("sse: drain period exceeded, giving up on remaining streams")
+		return
+	}
+	log.Println("sse: stopped")
+}
+
+func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.origins.Check(r) {
+		handshakeFailed("sse", "origin")
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+		if h.auth.usesCookies() {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	switch r.Method {
+	case "GET":
+		h.serveStream(w, r)
+	case "POST":
+		h.servePost(w, r)
+	case "OPTIONS":
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *SSEHandler) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	log.Println("sse: incoming stream")
+	proto, _, err := lookupProtocol(routeVersion(r.URL.Path), "json")
+	if err != nil {
+		log.Println("sse: rejecting stream:", err)
+		handshakeFailed("sse", "protocol")
+		rejectProtocol(w, err)
+		return
+	}
+	identity, err := h.auth.Authenticate(r)
+	if err != nil {
+		log.Println("sse: rejecting stream:", err)
+		handshakeFailed("sse", "auth")
+		rejectAuth(w, err)
+		return
+	}
+	if !h.conns.add() {
+		handshakeFailed("sse", "draining")
+		rejectBusy(w, errDraining)
+		return
+	}
+	defer h.conns.done()
+	ip := clientIP(r)
+	if err := acquireConn(ip); err != nil {
+		log.Println("sse: rejecting stream:", err)
+		handshakeFailed("sse", "busy")
+		rejectBusy(w, err)
+		return
+	}
+	defer caps.release(ip)
+
+	info := newConnInfo("sse", r.RemoteAddr, r.UserAgent())
+	info.Identity = identity
+	registry.Add(info)
+	defer registry.Remove(info)
+
+	// the connection-id doubles as stream-id
+	id := info.ID
+	q := newQueue(func() { info.kick(closeResyncRequired, "resync required") })
+	to_client := q.to_client
+	stream := &sseStream{
+		q:       q,
+		info:    info,
+		codec:   newVersionedCodec(proto, "json"),
+		limiter: newClientLimiter(r),
+	}
+	if proto.Version >= 1 {
+		stream.sessions = newSessionSet(q)
+	}
+	h.mu.Lock()
+	h.streams[id] = stream
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.streams, id)
+		h.mu.Unlock()
+		if stream.sessions != nil {
+			stream.sessions.detachAll()
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "event: stream\ndata: %s\n\n", id)
+	if notice := deprecationMsg(proto); notice != nil {
+		log.Printf("sse: client %s uses deprecated protocol version %d", id, proto.Version)
+		if muxed, err := stream.codec.Mux([][]byte{notice}); err == nil {
+			fmt.Fprintf(w, "data: %s\n\n", muxed)
+		}
+	}
+	flusher.Flush()
+	send := func(oe outEvent) error {
+		msgs, err := nextBatch(stream.codec, oe, to_client)
+		if err != nil {
+			log.Println("received invalid event from system", err)
+			return err
+		}
+		muxed, err := stream.codec.Mux(msgs)
+		if err != nil {
+			log.Println("could not mux outgoing messages into message-list", err)
+			return nil
+		}
+		if _, err = fmt.Fprintf(w, "data: %s\n\n", muxed); err != nil {
+			log.Println("sse: error writing to stream:", err)
+			return err
+		}
+		info.sent(len(msgs), len(muxed))
+		flusher.Flush()
+		return nil
+	}
+	heartbeat := time.NewTicker(*pingInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case oe := <-to_client:
+			if err := send(oe); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if exp := checkExpired(info); exp != nil {
+				if !exp.Reconnect {
+					fmt.Fprintf(w, "event: close\ndata: %s\n\n", exp.Reason)
+					flusher.Flush()
+					return
+				}
+				// polite reconnect: deliver what's pending first
+				for len(to_client) > 0 {
+					if err := send(<-to_client); err != nil {
+						return
+					}
+				}
+				fmt.Fprintf(w, "retry: %d\nevent: restart\ndata: %s\n\n", exp.Retry/time.Millisecond, exp.Reason)
+				flusher.Flush()
+				return
+			}
+			// heartbeat comment, keeps proxies from timing out the stream
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Println("sse: stream closed by client")
+			return
+		case <-info.kicked:
+			fmt.Fprintf(w, "event: close\ndata: %s\n\n", info.reason)
+			flusher.Flush()
+			return
+		case <-h.conns.stopping():
+			// shutdown: deliver what's pending, then tell the client when
+			// to reconnect (the retry field sets EventSource's delay)
+			for len(to_client) > 0 {
+				if err := send(<-to_client); err != nil {
+					return
+				}
+			}
+			retry := retryAfter()
+			fmt.Fprintf(w, "retry: %d\nevent: restart\ndata: %s\n\n", retry/time.Millisecond, restartReason(retry))
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+func (h *SSEHandler) servePost(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	stream, ok := h.streams[r.URL.Query().Get("stream")]
+	h.mu.Unlock()
+	if !ok || !h.owns(stream, r) {
+		http.Error(w, "unknown stream", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPostSize))
+	if err != nil {
+		http.Error(w, "cannot read request body", http.StatusBadRequest)
+		return
+	}
+	// malformed messages are answered with a list of error messages;
+	// in lenient mode the valid ones are handled nevertheless.
+	perrs, throttled := [][]byte{}, [][]byte{}
+	events, controls := []incoming{}, []controlMsg{}
+	msgs, err := stream.codec.Demux(body)
+	if err != nil {
+		log.Println("error de-muxing message list from client", err)
+		perrs = append(perrs, newProtocolError(errInvalidMsgList, nil, err).Msg())
+	}
+	for i := range msgs {
+		if stream.sessions != nil {
+			if ctrl, ok := parseControl(msgs[i]); ok {
+				stream.info.received(ctrl.SID, len(msgs[i]))
+				controls = append(controls, ctrl)
+				continue
+			}
+		}
+		event, err := stream.codec.MsgToEvent(msgs[i])
+		if err != nil {
+			log.Println("invalid Message received", err)
+			perrs = append(perrs, newProtocolError(errInvalidMsg, msgs[i], err).Msg())
+			continue
+		}
+		stream.info.received(event.SID, len(msgs[i]))
+		if !stream.limiter.Allow(event.Name) {
+			throttled = append(throttled, newProtocolError(errThrottled, msgs[i], errRateLimited).Msg())
+			continue
+		}
+		in := newIncoming(event)
+		in.Context(clientContext(stream.q, stream.sessions, in.cid))
+		events = append(events, in)
+	}
+	// handle events of one stream sequentially, like the WebSocket
+	// transport does for a connection
+	stream.Lock()
+	defer stream.Unlock()
+	if len(perrs) > 0 {
+		stats.Add("protocol_errors", int64(len(perrs)))
+		stream.protoErrors += len(perrs)
+		if tooManyProtocolErrors(stream.protoErrors) {
+			log.Println("sse: closing stream after malformed message")
+			stream.info.kick(websocket.CloseProtocolError, "malformed message")
+			writeMsgList(w, http.StatusBadRequest, perrs)
+			return
+		}
+	}
+	if len(throttled) > 0 {
+		stream.violations += len(throttled)
+		perrs = append(perrs, throttled...)
+		if tooManyRateViolations(stream.violations) {
+			log.Printf("sse: closing stream of %s after %d rate limit violations", stream.limiter.ip, stream.violations)
+			stream.info.kick(websocket.ClosePolicyViolation, "rate limit exceeded")
+			writeMsgList(w, http.StatusTooManyRequests, perrs)
+			return
+		}
+	}
+	for _, ctrl := range controls {
+		stream.sessions.control(ctrl)
+	}
+	for i := range events {
+		if stream.sessions != nil {
+			stream.sessions.attach(events[i].SID)
+		}
+		handleEvent(h.srv, stream.info, events[i])
+	}
+	if len(perrs) > 0 {
+		writeMsgList(w, http.StatusOK, perrs)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// owns reports whether r comes from the client of stream. The stream-id is
+// no secret (it shows up in logs and the admin interface), so posts must
+// come from the stream's IP and carry the credentials it was opened with.
+func (h *SSEHandler) owns(stream *sseStream, r *http.Request) bool {
+	if clientIP(r) != stream.limiter.ip {
+		return false
+	}
+	identity, err := h.auth.Authenticate(r)
+	if err != nil {
+		return false
+	}
+	if identity == nil || stream.info.Identity == nil {
+		return identity == stream.info.Identity
+	}
+	return *identity == *stream.info.Identity
+}
+
+func writeMsgList(w http.ResponseWriter, status int, msgs [][]byte) {
+	muxed, err := adapter.Mux(msgs)
+	if err != nil {
+		log.Println("could not mux outgoing messages into message-list", err)
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(muxed)
+}
+
+func randomID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
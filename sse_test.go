@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroapp-com/diffsync"
+)
+
+// testSSEServer serves an SSEHandler without sync server on /0/sse and
+// /1/sse.
+func testSSEServer(t *testing.T, auth *Authenticator) (*SSEHandler, *httptest.Server) {
+	origins, err := NewOriginChecker(OriginPolicy{AllowMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewSSEHandler(nil, origins, auth)
+	mux := http.NewServeMux()
+	mux.Handle("/0/sse", h)
+	mux.Handle("/1/sse", h)
+	return h, httptest.NewServer(mux)
+}
+
+// sseClient reads the events of a stream.
+type sseClient struct {
+	id    string
+	resp  *http.Response
+	lines *bufio.Scanner
+}
+
+// openStream opens a stream and reads its stream-id; header is added to
+// the request.
+func openStream(t *testing.T, url string, header http.Header) *sseClient {
+	req, _ := http.NewRequest("GET", url, nil)
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &sseClient{resp: resp, lines: bufio.NewScanner(resp.Body)}
+	name, data := c.next()
+	if resp.StatusCode != http.StatusOK || name != "stream" || data == "" {
+		t.Fatalf("expected stream event, got %d %s: %s", resp.StatusCode, name, data)
+	}
+	c.id = data
+	return c
+}
+
+// next returns the name and data of the next event; the name of unnamed
+// events is empty.
+func (c *sseClient) next() (string, string) {
+	name, data := "", ""
+	for c.lines.Scan() {
+		line := c.lines.Text()
+		switch {
+		case line == "" && data != "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return "", ""
+}
+
+// messages returns the names of the messages of the next events until one
+// named last arrives.
+func (c *sseClient) messages(last string) []string {
+	names := []string{}
+	for {
+		_, data := c.next()
+		msgs := []struct {
+			Name string `json:"name"`
+		}{}
+		if data == "" || json.Unmarshal([]byte(data), &msgs) != nil {
+			return names
+		}
+		for _, m := range msgs {
+			names = append(names, m.Name)
+			if m.Name == last {
+				return names
+			}
+		}
+	}
+}
+
+func (c *sseClient) Close() {
+	c.resp.Body.Close()
+}
+
+func post(t *testing.T, url, id, body string, header http.Header) *http.Response {
+	req, _ := http.NewRequest("POST", url+"?stream="+id, strings.NewReader(body))
+	for k := range header {
+		req.Header.Set(k, header.Get(k))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestSSEStream(t *testing.T) {
+	h, ts := testSSEServer(t, nil)
+	defer ts.Close()
+	stream := openStream(t, ts.URL+"/0/sse", nil)
+	defer func() {
+		stream.Close()
+		h.conns.wait()
+	}()
+	assert(t, stream.resp.Header.Get("Content-Type") == "text/event-stream", "unexpected content type %s", stream.resp.Header.Get("Content-Type"))
+
+	resp := post(t, ts.URL+"/0/sse", stream.id, `[{"name": 42}]`, nil)
+	assert(t, resp.StatusCode == http.StatusOK, "malformed messages should be answered with errors, got %d", resp.StatusCode)
+	resp = post(t, ts.URL+"/0/sse", stream.id, `[]`, nil)
+	assert(t, resp.StatusCode == http.StatusNoContent, "valid posts should be accepted, got %d", resp.StatusCode)
+}
+
+func TestSSEForeignPosts(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	trustedProxies = []*net.IPNet{local}
+	a, _ := NewAuthenticator(mapTokenStore{"tok1": {Kind: "login", UID: "u1"}, "tok2": {Kind: "login", UID: "u2"}}, authRequired, nil, "", nil)
+	h, ts := testSSEServer(t, a)
+	defer ts.Close()
+
+	owner := http.Header{"Authorization": {"Bearer tok1"}, "X-Forwarded-For": {"198.51.100.1"}}
+	stream := openStream(t, ts.URL+"/0/sse", owner)
+	defer func() {
+		stream.Close()
+		h.conns.wait()
+	}()
+	for name, header := range map[string]http.Header{
+		"other user": {"Authorization": {"Bearer tok2"}, "X-Forwarded-For": {"198.51.100.1"}},
+		"other IP":   {"Authorization": {"Bearer tok1"}, "X-Forwarded-For": {"198.51.100.2"}},
+		"no auth":    {"X-Forwarded-For": {"198.51.100.1"}},
+	} {
+		resp := post(t, ts.URL+"/0/sse", stream.id, `[]`, header)
+		assert(t, resp.StatusCode == http.StatusNotFound, "%s: post to foreign stream should be rejected, got %d", name, resp.StatusCode)
+	}
+	resp := post(t, ts.URL+"/0/sse", "unknown", `[]`, owner)
+	assert(t, resp.StatusCode == http.StatusNotFound, "post to unknown stream should be rejected, got %d", resp.StatusCode)
+	resp = post(t, ts.URL+"/0/sse", stream.id, `[]`, owner)
+	assert(t, resp.StatusCode == http.StatusNoContent, "post of the stream's client should be accepted, got %d", resp.StatusCode)
+}
+
+func TestSSEResume(t *testing.T) {
+	defer func(rs *resumeStore) { resumes = rs }(resumes)
+	resumes = newResumeStore()
+	// events sent while the client was away
+	for _, name := range []string{"res-sync", "res-sync"} {
+		resumes.record(diffsync.Event{Name: name, SID: "s1"})
+	}
+	h, ts := testSSEServer(t, nil)
+	defer ts.Close()
+	stream := openStream(t, ts.URL+"/1/sse", nil)
+	defer func() {
+		stream.Close()
+		h.conns.wait()
+	}()
+	done := make(chan []string)
+	go func() { done <- stream.messages("session-resume") }()
+
+	resp := post(t, ts.URL+"/1/sse", stream.id, `[{"name": "session-resume", "sid": "s1", "tag": "t", "last_seq": 0}]`, nil)
+	assert(t, resp.StatusCode == http.StatusNoContent, "resume should be accepted, got %d", resp.StatusCode)
+	select {
+	case names := <-done:
+		assert(t, strings.Join(names, ",") == "res-sync,res-sync,session-resume", "missed events and reply should be delivered over the stream, got %v", names)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply on the stream")
+	}
+
+	// the session is now served by the stream
+	oe, live := resumes.record(diffsync.Event{Name: "res-sync", SID: "s1"})
+	if assert(t, live != nil, "resumed session should be attached to the stream") {
+		live.push(oe)
+		assert(t, strings.Join(stream.messages("res-sync"), ",") == "res-sync", "new events should be delivered over the stream")
+	}
+}
+
+func TestSSECORSCredentials(t *testing.T) {
+	origins, err := NewOriginChecker(OriginPolicy{Origins: []string{"https://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preflight := func(auth *Authenticator) http.Header {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("OPTIONS", "/0/sse", nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		NewSSEHandler(nil, origins, auth).ServeHTTP(w, r)
+		return w.Header()
+	}
+	header := preflight(nil)
+	assert(t, header.Get("Access-Control-Allow-Origin") == "https://app.example.com", "origin should be allowed, got %q", header.Get("Access-Control-Allow-Origin"))
+	assert(t, header.Get("Access-Control-Allow-Credentials") == "", "credentials should not be allowed without cookie auth")
+
+	a, _ := NewAuthenticator(mapTokenStore{}, authRequired, nil, "hync_auth", []byte("secret"))
+	header = preflight(a)
+	assert(t, header.Get("Access-Control-Allow-Credentials") == "true", "credentials should be allowed with cookie auth")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stats holds hync's runtime counters. they are published via expvar and
+// thus available as JSON at /debug/vars on listeners serving the metrics
+// handlers.
+var stats = expvar.NewMap("hync")
+
+func count(name string) {
+	stats.Add(name, 1)
+}
+
+// histogram counts observations into buckets with the given (inclusive)
+// upper bounds, plus an implicit +Inf bucket.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+	total  int64
+}
+
+// newHistogram creates a histogram and publishes it in stats.
+func newHistogram(name string, bounds ...float64) *histogram {
+	h := &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+	stats.Set(name, h)
+	return h
+}
+
+func (h *histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.total++
+	h.mu.Unlock()
+}
+
+// snapshot returns copies of the (non-cumulative) bucket counts, the sum
+// and the number of observations.
+func (h *histogram) snapshot() ([]int64, float64, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]int64(nil), h.counts...), h.sum, h.total
+}
+
+// String implements expvar.Var
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]string, len(h.counts))
+	for i := range h.bounds {
+		buckets[i] = fmt.Sprintf("%q: %d", strconv.FormatFloat(h.bounds[i], 'g', -1, 64), h.counts[i])
+	}
+	buckets[len(h.bounds)] = fmt.Sprintf("\"+Inf\": %d", h.counts[len(h.bounds)])
+	return fmt.Sprintf("{\"count\": %d, \"sum\": %g, \"buckets\": {%s}}", h.total, h.sum, strings.Join(buckets, ", "))
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+)
+
+// TCPServer is the transport for native and backend clients which would
+// rather not speak WebSocket. Every line sent in either direction is a JSON
+// message list, exactly like a WebSocket frame (current protocol version).
+// Empty lines are heartbeats: hync sends one every -ping_interval and closes
+// connections which stayed silent for -ws_max_missed_pongs intervals, so
+// clients should send one of their own if they have nothing else to say.
+//
+// Before closing a connection, hync sends a last line holding a list with a
+// single "close" or (on shutdown or after -max_conn_lifetime) "restart"
+// message with the reason. Connections exceeding -max_conns or
+// -max_conns_per_ip only get a "close" with code 1013 (try again later).
+//
+// Unless -auth is off, the first line must authenticate the client like the
+// credentials of a WebSocket handshake do:
+//
+//	[{"name": "auth", "token": "<token>"}]
+//
+// The token may be empty for anonymous clients if -auth is optional.
+// Clients failing authentication get a "close" with code 4000 plus the HTTP
+// status a WebSocket handshake would have been rejected with, e.g. 4401.
+type TCPServer struct {
+	srv   *diffsync.Server
+	auth  *Authenticator
+	conns *connGroup
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+func NewTCPServer(s *diffsync.Server, auth *Authenticator) *TCPServer {
+	return &TCPServer{srv: s, auth: auth, conns: newConnGroup()}
+}
+
+// Serve accepts connections on ln until the server is stopped.
+func (ts *TCPServer) Serve(ln net.Listener) error {
+	ts.mu.Lock()
+	ts.ln = ln
+	ts.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ts.conns.stopping():
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Println("tcp: accept failed:", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !ts.conns.add() {
+			conn.Close()
+			return nil
+		}
+		go ts.serveConn(conn)
+	}
+}
+
+// Stop closes the listener and makes all connections flush their pending
+// events and close with a reconnect hint. It waits for the connections to
+// finish until ctx expires.
+func (ts *TCPServer) Stop(ctx context.Context) {
+	log.Println("tcp: shutting down connections")
+	// before closing the listener, so that Serve takes the accept error
+	// for a stop
+	ts.conns.startDrain()
+	ts.mu.Lock()
+	if ts.ln != nil {
+		ts.ln.Close()
+	}
+	ts.mu.Unlock()
+	if !ts.conns.drain(ctx) {
+		log.Println("tcp: drain period exceeded, giving up on remaining connections")
+		return
+	}
+	log.Println("tcp: stopped")
+}
+
+// tcpClose is the last message sent before hync closes a connection.
+type tcpClose struct {
+	Name    string `json:"name"`
+	Code    int    `json:"code,omitempty"`
+	Reason  string `json:"reason"`
+	RetryMS int64  `json:"retry_ms,omitempty"`
+}
+
+// tcpAuth is the first message of a connection if -auth is not off.
+type tcpAuth struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+// authenticate reads the auth line from lines and returns the identity of
+// the client.
+func (ts *TCPServer) authenticate(nc net.Conn, lines *bufio.Scanner) (*Identity, error) {
+	if ts.auth == nil {
+		return nil, nil
+	}
+	nc.SetReadDeadline(time.Now().Add(pongWait()))
+	for lines.Scan() {
+		if len(lines.Bytes()) == 0 {
+			// heartbeat
+			continue
+		}
+		msgs := []tcpAuth{}
+		if err := json.Unmarshal(lines.Bytes(), &msgs); err != nil || len(msgs) != 1 || msgs[0].Name != "auth" {
+			count("auth_invalid")
+			return nil, &authError{http.StatusUnauthorized, "first message must be auth"}
+		}
+		return ts.auth.identify(msgs[0].Token)
+	}
+	return nil, &authError{http.StatusUnauthorized, "authentication required"}
+}
+
+// reject sends bye and closes a connection which was not accepted.
+func reject(nc net.Conn, bye tcpClose) {
+	if msg, err := json.Marshal([]tcpClose{bye}); err == nil {
+		nc.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		nc.Write(append(msg, '\n'))
+	}
+	nc.Close()
+}
+
+// tcpConn is the server side of a single TCP connection.
+type tcpConn struct {
+	*countingConn
+	w         *bufio.Writer
+	info      *connInfo
+	codec     Codec
+	to_client chan outEvent
+}
+
+// writeBatch sends first and whatever else is queued in to_client as a
+// single line.
+func (c *tcpConn) writeBatch(first outEvent) error {
+	msgs, err := nextBatch(c.codec, first, c.to_client)
+	if err != nil {
+		log.Println("received invalid event from system", err)
+		return err
+	}
+	return c.writeMsgs(msgs)
+}
+
+// writeMsgs sends msgs as a single message-list line.
+func (c *tcpConn) writeMsgs(msgs [][]byte) error {
+	muxed, err := c.codec.Mux(msgs)
+	if err != nil {
+		log.Println("could not mux outgoing messages into message-list", err)
+		return nil
+	}
+	if err := c.writeLine(muxed); err != nil {
+		log.Printf("error writing to tcp connection %s: %v", c.info.ID, err)
+		return err
+	}
+	c.info.sent(len(msgs), len(muxed))
+	stats.Add("tcp_bytes_out", int64(len(muxed)))
+	return nil
+}
+
+func (c *tcpConn) writeLine(line []byte) error {
+	c.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	c.w.Write(line)
+	c.w.WriteByte('\n')
+	return c.w.Flush()
+}
+
+// flush sends all events currently queued in to_client.
+func (c *tcpConn) flush() error {
+	for {
+		select {
+		case oe := <-c.to_client:
+			if err := c.writeBatch(oe); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (ts *TCPServer) serveConn(nc net.Conn) {
+	defer ts.conns.done()
+	info := newConnInfo("tcp", nc.RemoteAddr().String(), "")
+	log.Printf("tcp: incoming connection %s from %s", info.ID, nc.RemoteAddr())
+	if tc, ok := nc.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(*pingInterval)
+	}
+	host, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+	if err := acquireConn(host); err != nil {
+		log.Printf("tcp: rejecting connection %s: %v", info.ID, err)
+		handshakeFailed("tcp", "busy")
+		reject(nc, tcpClose{Name: "close", Code: websocket.CloseTryAgainLater, Reason: err.Error()})
+		return
+	}
+	defer caps.release(host)
+	wire := &countingConn{Conn: nc}
+	lines := bufio.NewScanner(wire)
+	lines.Buffer(make([]byte, 4096), int(*wsMaxMessage))
+	identity, err := ts.authenticate(nc, lines)
+	if err != nil {
+		log.Printf("tcp: rejecting connection %s: %v", info.ID, err)
+		handshakeFailed("tcp", "auth")
+		code := 4000 + http.StatusUnauthorized
+		if aerr, ok := err.(*authError); ok {
+			code = 4000 + aerr.Status
+		}
+		reject(nc, tcpClose{Name: "close", Code: code, Reason: err.Error()})
+		return
+	}
+	info.wire = wire
+	info.Identity = identity
+	registry.Add(info)
+	defer registry.Remove(info)
+
+	q := newQueue(func() { info.kick(closeResyncRequired, "resync required") })
+	conn := &tcpConn{
+		countingConn: wire,
+		w:            bufio.NewWriter(wire),
+		info:         info,
+		codec:        newVersionedCodec(protocols[currentProtocol], "json"),
+		to_client:    q.to_client,
+	}
+	bye := tcpClose{Name: "close", Code: websocket.CloseNormalClosure}
+	defer func(c *tcpConn) {
+		if msg, err := json.Marshal([]tcpClose{bye}); err == nil {
+			c.writeLine(msg)
+		}
+		c.Close()
+		log.Printf("tcp: connection %s closed; sent %d bytes payload, %d bytes on the wire", c.info.ID, c.info.status().BytesOut, c.BytesWritten())
+	}(conn)
+
+	from_client := make(chan incoming)
+	sessions := newSessionSet(q)
+	defer sessions.detachAll()
+	limiter := &clientLimiter{ip: host, conn: newRateLimiter(connLimits), ips: ipLimiter}
+
+	// read lines and pipe the events into the incoming pipe; malformed
+	// and throttled messages are reported to proto_errs.
+	proto_errs := make(chan protocolError)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func(ch chan incoming) {
+		defer close(ch)
+		report := func(perr protocolError) bool {
+			select {
+			case proto_errs <- perr:
+				return true
+			case <-quit:
+				return false
+			}
+		}
+		for {
+			conn.SetReadDeadline(time.Now().Add(pongWait()))
+			if !lines.Scan() {
+				log.Printf("error reading from tcp connection %s: %v", info.ID, lines.Err())
+				return
+			}
+			line := lines.Bytes()
+			if len(line) == 0 {
+				// heartbeat
+				continue
+			}
+			msgs, err := conn.codec.Demux(line)
+			if err != nil {
+				log.Println("error de-muxing message list from client", err)
+				if !report(newProtocolError(errInvalidMsgList, nil, err)) {
+					return
+				}
+				continue
+			}
+			for i := range msgs {
+				if ctrl, ok := parseControl(msgs[i]); ok {
+					info.received(ctrl.SID, len(msgs[i]))
+					sessions.control(ctrl)
+					continue
+				}
+				event, err := conn.codec.MsgToEvent(msgs[i])
+				if err != nil {
+					log.Println("invalid Message received", err)
+					if !report(newProtocolError(errInvalidMsg, msgs[i], err)) {
+						return
+					}
+					continue
+				}
+				info.received(event.SID, len(msgs[i]))
+				if !limiter.Allow(event.Name) {
+					if !report(newProtocolError(errThrottled, msgs[i], errRateLimited)) {
+						return
+					}
+					continue
+				}
+				sessions.attach(event.SID)
+				in := newIncoming(event)
+				in.Context(clientContext(q, sessions, in.cid))
+				select {
+				case ch <- in:
+				case <-quit:
+					return
+				}
+			}
+		}
+	}(from_client)
+	protoErrors, violations := 0, 0
+	heartbeat := time.NewTicker(*pingInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case in, ok := <-from_client:
+			if !ok {
+				// read failed or timed out, shutting down connection
+				return
+			}
+			handleEvent(ts.srv, info, in)
+		case perr := <-proto_errs:
+			if err := conn.writeMsgs([][]byte{perr.Msg()}); err != nil {
+				return
+			}
+			if perr.Code == errThrottled {
+				if violations++; tooManyRateViolations(violations) {
+					log.Printf("tcp: disconnecting client %s after %d rate limit violations", limiter.ip, violations)
+					bye = tcpClose{Name: "close", Code: websocket.ClosePolicyViolation, Reason: "rate limit exceeded"}
+					return
+				}
+				continue
+			}
+			protoErrors++
+			count("protocol_errors")
+			if tooManyProtocolErrors(protoErrors) {
+				log.Println("tcp: disconnecting client after malformed message:", perr)
+				bye = tcpClose{Name: "close", Code: websocket.CloseProtocolError, Reason: "malformed message"}
+				return
+			}
+		case oe := <-q.to_client:
+			if err := conn.writeBatch(oe); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if exp := checkExpired(info); exp != nil {
+				if exp.Reconnect {
+					// polite reconnect: deliver what's pending first
+					if err := conn.flush(); err != nil {
+						return
+					}
+					bye = tcpClose{Name: "restart", Code: exp.Code, Reason: exp.Reason, RetryMS: int64(exp.Retry / time.Millisecond)}
+				} else {
+					bye = tcpClose{Name: "close", Code: exp.Code, Reason: exp.Reason}
+				}
+				return
+			}
+			if err := conn.writeLine(nil); err != nil {
+				log.Printf("tcp: error sending heartbeat to %s: %v", info.ID, err)
+				return
+			}
+		case <-info.kicked:
+			bye = tcpClose{Name: "close", Code: info.code, Reason: info.reason}
+			return
+		case <-ts.conns.stopping():
+			// shutdown: deliver what's pending and tell the client when to
+			// come back
+			if err := conn.flush(); err != nil {
+				return
+			}
+			retry := retryAfter()
+			bye = tcpClose{Name: "restart", Code: websocket.CloseServiceRestart, Reason: restartReason(retry), RetryMS: int64(retry / time.Millisecond)}
+			return
+		}
+	}
+}
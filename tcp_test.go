@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+)
+
+func TestTCPProtocolErrorAndShutdown(t *testing.T) {
+	ts := NewTCPServer(nil, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	ts.conns.add()
+	go ts.serveConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(client)
+
+	client.Write([]byte("\nnot json\n"))
+	assert(t, lines.Scan(), "expected an answer, got %v", lines.Err())
+	errs := []protocolError{}
+	err := json.Unmarshal(lines.Bytes(), &errs)
+	assert(t, err == nil && len(errs) == 1 && errs[0].Code == errInvalidMsgList, "expected invalid-msglist error, got %s", lines.Bytes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go ts.Stop(ctx)
+	assert(t, lines.Scan(), "expected a restart message, got %v", lines.Err())
+	bye := []tcpClose{}
+	err = json.Unmarshal(lines.Bytes(), &bye)
+	assert(t, err == nil && len(bye) == 1 && bye[0].Name == "restart" && bye[0].RetryMS > 0, "expected restart message, got %s", lines.Bytes())
+}
+
+func TestTCPServeStop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTCPServer(nil, nil)
+	served := make(chan error)
+	go func() { served <- ts.Serve(ln) }()
+	// wait for Serve to take the listener
+	for {
+		ts.mu.Lock()
+		taken := ts.ln != nil
+		ts.mu.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ts.Stop(ctx)
+	select {
+	case err := <-served:
+		assert(t, err == nil, "Serve should return nil when stopped, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+}
+
+func TestTCPResyncThenContinue(t *testing.T) {
+	defer func(rs *resumeStore) { resumes = rs }(resumes)
+	resumes = newResumeStore()
+	ts := NewTCPServer(nil, nil)
+	client, server := net.Pipe()
+	defer func() {
+		client.Close()
+		ts.conns.wait()
+	}()
+	ts.conns.add()
+	go ts.serveConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(client)
+
+	client.Write([]byte(`[{"name":"session-resume","sid":"s","tag":"t","last_seq":3}]` + "\n"))
+	assert(t, lines.Scan(), "expected a resume reply, got %v", lines.Err())
+	replies := []resumeReply{}
+	err := json.Unmarshal(lines.Bytes(), &replies)
+	assert(t, err == nil && len(replies) == 1 && replies[0].Status == "resync-required", "expected resync-required, got %s", lines.Bytes())
+
+	// the events of the resync must reach the connection
+	other := newQueue(nil)
+	clientContext(other, newSessionSet(other), "cid").Client.Handle(diffsync.Event{Name: "res-sync", SID: "s", Tag: "t"})
+	assert(t, lines.Scan(), "expected the resync event, got %v", lines.Err())
+	events := []struct {
+		Name string `json:"name"`
+		Seq  uint64 `json:"seq"`
+	}{}
+	err = json.Unmarshal(lines.Bytes(), &events)
+	assert(t, err == nil && len(events) == 1 && events[0].Name == "res-sync" && events[0].Seq == 1, "expected res-sync with seq 1, got %s", lines.Bytes())
+	assert(t, len(other.to_client) == 0, "event went to the wrong connection")
+}
+
+func TestTCPBusy(t *testing.T) {
+	defer func(c *connCaps, max int) { caps, *maxConns = c, max }(caps, *maxConns)
+	caps, *maxConns = newConnCaps(), 1
+	caps.acquire("other", 1, 0)
+	ts := NewTCPServer(nil, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	ts.conns.add()
+	go ts.serveConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	lines := bufio.NewScanner(client)
+	assert(t, lines.Scan(), "expected a close message, got %v", lines.Err())
+	bye := []tcpClose{}
+	err := json.Unmarshal(lines.Bytes(), &bye)
+	assert(t, err == nil && len(bye) == 1 && bye[0].Code == websocket.CloseTryAgainLater, "expected close with code 1013, got %s", lines.Bytes())
+	ts.conns.wait()
+}
+
+func TestTCPAuth(t *testing.T) {
+	a, _ := NewAuthenticator(mapTokenStore{"usertok": {Kind: "login", UID: "u1"}}, authRequired, nil, "", nil)
+	ts := NewTCPServer(nil, a)
+	for first, code := range map[string]int{
+		`[{"name":"client-ehlo","sid":"s"}]`:  4401,
+		`[{"name":"auth","token":""}]`:        4401,
+		`[{"name":"auth","token":"bad"}]`:     4401,
+		`[{"name":"auth","token":"usertok"}]`: websocket.CloseNormalClosure,
+	} {
+		client, server := net.Pipe()
+		ts.conns.add()
+		go ts.serveConn(server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		client.Write([]byte(first + "\n"))
+		lines := bufio.NewScanner(client)
+		if code == websocket.CloseNormalClosure {
+			// accepted clients get answers
+			client.Write([]byte("not json\n"))
+			errs := []protocolError{}
+			assert(t, lines.Scan() && json.Unmarshal(lines.Bytes(), &errs) == nil && len(errs) == 1, "%s: expected a protocol error, got %s", first, lines.Bytes())
+			client.Close()
+			continue
+		}
+		assert(t, lines.Scan(), "%s: expected a close message, got %v", first, lines.Err())
+		bye := []tcpClose{}
+		err := json.Unmarshal(lines.Bytes(), &bye)
+		assert(t, err == nil && len(bye) == 1 && bye[0].Code == code, "%s: expected close with code %d, got %s", first, code, lines.Bytes())
+		client.Close()
+	}
+	ts.conns.wait()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves a certificate which can be replaced at runtime. The
+// certificate is only used for new handshakes, so open connections are not
+// affected by a reload.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate from disk. On error, the current
+// certificate is kept.
+func (cr *certReloader) Reload() error {
+	modTime, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert, cr.modTime = &cert, modTime
+	cr.mu.Unlock()
+	log.Printf("tls: loaded certificate %s", cr.certFile)
+	return nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	latest := time.Time{}
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Watch reloads the certificate whenever its files change, checking every
+// interval.
+func (cr *certReloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTime, err := cr.lastModified()
+		cr.mu.RLock()
+		changed := err == nil && !modTime.Equal(cr.modTime)
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := cr.Reload(); err != nil {
+			log.Println("tls: reload of changed certificate failed, keeping current one:", err)
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// tlsConfig returns the TLS config for a listener serving cr.
+func tlsConfig(cr *certReloader) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[*tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid -tls_min_version `%s`, must be one of 1.0, 1.1, 1.2, 1.3", *tlsMinVersion)
+	}
+	return &tls.Config{GetCertificate: cr.GetCertificate, MinVersion: minVersion}, nil
+}
+
+// certReloaders holds the certificates of all TLS listeners, so that they
+// can be reloaded on SIGHUP.
+var certReloaders = []*certReloader{}
+
+// setupTLS returns the TLS config for a listener with the given
+// certificate, or nil if certFile and keyFile are empty.
+func setupTLS(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key")
+	}
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if *tlsWatch > 0 {
+		go cr.Watch(*tlsWatch)
+	}
+	certReloaders = append(certReloaders, cr)
+	return tlsConfig(cr)
+}
+
+// reloadCerts reloads all certificates, e.g. on SIGHUP.
+func reloadCerts() {
+	for _, cr := range certReloaders {
+		if err := cr.Reload(); err != nil {
+			log.Println("tls: reload failed, keeping current certificate:", err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for cn to dir.
+func writeCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func servedCN(t *testing.T, cr *certReloader) string {
+	cert, _ := cr.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir, "first")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, servedCN(t, cr) == "first", "unexpected certificate %s", servedCN(t, cr))
+
+	writeCert(t, dir, "second")
+	assert(t, cr.Reload() == nil, "reload failed")
+	assert(t, servedCN(t, cr) == "second", "certificate not reloaded")
+
+	// a broken certificate keeps the current one
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	assert(t, cr.Reload() != nil, "reload of broken certificate should fail")
+	assert(t, servedCN(t, cr) == "second", "broken certificate replaced the current one")
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	defer func(v string) { *tlsMinVersion = v }(*tlsMinVersion)
+	cr := &certReloader{}
+	*tlsMinVersion = "1.3"
+	conf, err := tlsConfig(cr)
+	assert(t, err == nil && conf.MinVersion == tls.VersionTLS13, "unexpected config %v, %v", conf, err)
+	*tlsMinVersion = "1.4"
+	_, err = tlsConfig(cr)
+	assert(t, err != nil, "invalid min version accepted")
+}
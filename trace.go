@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hiroapp-com/diffsync"
+	"github.com/hiroapp-com/hync/comm"
+)
+
+// Every event received from a client gets a correlation id (cid). It is
+// printed in the log lines about the event, attached to the events sent to
+// the client while handling it (via the diffsync.Context passed down with
+// the event) and used as trace id of the event's span.
+//
+// diffsync.Context has no room for the id, so it does not reach the
+// comm.Requests diffsync creates while handling an event: those get their
+// own id in comm.NewRequest, which is logged by the comm handlers and the
+// RPC server and used as trace id of the request's span.
+
+// incoming is an event received from a client.
+type incoming struct {
+	diffsync.Event
+	cid string
+}
+
+func newIncoming(event diffsync.Event) incoming {
+	return incoming{Event: event, cid: randomID()}
+}
+
+// handleEvent passes an incoming event to the server.
+func handleEvent(srv *diffsync.Server, info *connInfo, in incoming) {
+	log.Printf("%s: [%s] received %v", info.Transport, in.cid, in.Event)
+	sp := tracer.start(in.cid, "hync.event", map[string]interface{}{
+		"event.name": in.Name,
+		"event.sid":  in.SID,
+		"transport":  info.Transport,
+		"conn.id":    info.ID,
+	})
+	eventsReceived.Inc(in.Name)
+	start := time.Now()
+	err := srv.Handle(in.Event)
+	handleDuration.Observe(time.Since(start).Seconds(), in.Name)
+	if err != nil {
+		log.Printf("%s: [%s] server could not handle incoming event: %s", info.Transport, in.cid, err)
+	}
+	sp.end(err)
+}
+
+// span is an OpenTelemetry-style span, written as one JSON line per span.
+type span struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start_time"`
+	End        time.Time              `json:"end_time"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	exporter   *spanExporter
+}
+
+// end finishes and exports the span; nil spans are ignored.
+func (sp *span) end(err error) {
+	if sp == nil {
+		return
+	}
+	sp.End, sp.Status = time.Now(), "ok"
+	if err != nil {
+		sp.Status, sp.Error = "error", err.Error()
+	}
+	sp.exporter.export(sp)
+}
+
+// spanExporter writes finished spans to a file or stdout (-trace_file).
+type spanExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// tracer is nil unless -trace_file is set.
+var tracer *spanExporter
+
+func setupTracing() error {
+	switch *traceFile {
+	case "":
+		return nil
+	case "-":
+		tracer = &spanExporter{enc: json.NewEncoder(os.Stdout)}
+		return nil
+	}
+	f, err := os.OpenFile(*traceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	tracer = &spanExporter{enc: json.NewEncoder(f)}
+	return nil
+}
+
+// start starts a span; it returns nil if tracing is disabled.
+func (e *spanExporter) start(traceID, name string, attrs map[string]interface{}) *span {
+	if e == nil {
+		return nil
+	}
+	return &span{TraceID: traceID, SpanID: randomID()[:16], Name: name, Start: time.Now(), Attributes: attrs, exporter: e}
+}
+
+func (e *spanExporter) export(sp *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(sp); err != nil {
+		log.Println("trace: cannot export span:", err)
+	}
+}
+
+// traceComm wraps the comm handler, so that every request gets a span.
+func traceComm(handler comm.Handler) comm.Handler {
+	return func(req comm.Request) error {
+		if req.ID == "" {
+			req.ID = comm.NewRequestID()
+		}
+		sp := tracer.start(req.ID, "comm.request", map[string]interface{}{"comm.kind": req.Kind})
+		err := handler(req)
+		sp.end(err)
+		return err
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/hiroapp-com/hync/comm"
+)
+
+func TestTraceComm(t *testing.T) {
+	defer func(e *spanExporter) { tracer = e }(tracer)
+	buf := &bytes.Buffer{}
+	tracer = &spanExporter{enc: json.NewEncoder(buf)}
+
+	var seen string
+	handler := traceComm(func(req comm.Request) error {
+		seen = req.ID
+		return errors.New("provider down")
+	})
+	handler(comm.Request{Kind: "invite"})
+	assert(t, seen != "", "request without id should get one")
+
+	sp := span{}
+	err := json.Unmarshal(buf.Bytes(), &sp)
+	assert(t, err == nil, "invalid span %s", buf.Bytes())
+	assert(t, sp.TraceID == seen && sp.Name == "comm.request", "unexpected span %#v", sp)
+	assert(t, sp.Status == "error" && sp.Error == "provider down", "error not recorded in span %#v", sp)
+}
+
+func TestTracingDisabled(t *testing.T) {
+	var e *spanExporter
+	sp := e.start("cid", "hync.event", nil)
+	assert(t, sp == nil, "disabled tracer should not create spans")
+	sp.end(nil)
+}
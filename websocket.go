@@ -1,163 +1,411 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/hiroapp-com/diffsync"
 	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
 )
 
+// closeResyncRequired is the close code sent to clients which need to do a
+// full resync after reconnecting.
+const closeResyncRequired = 4001
+
 var (
 	adapter         = diffsync.NewJsonAdapter()
+	batchSizes      = newHistogram("batch_size", 1, 2, 4, 8, 16, 32, 64)
 	defaultUpgrader = websocket.Upgrader{
-		ReadBufferSize:   1024,
-		WriteBufferSize:  1024,
-		Subprotocols:     []string{"hync"},
-		HandshakeTimeout: 5 * time.Second,
-		CheckOrigin: func(r *http.Request) bool {
-			switch r.Header.Get("Origin") {
-			case "http://localhost:5000", "https://beta.hiroapp.com", "https://www.hiroapp.com":
-			default:
-				return false
-			}
-			return true
-		},
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		HandshakeTimeout:  5 * time.Second,
+		EnableCompression: true,
 	}
 )
 
 type WsHandler struct {
-	srv  *diffsync.Server
-	wg   sync.WaitGroup
-	done chan struct{}
+	srv   *diffsync.Server
+	auth  *Authenticator
+	conns *connGroup
 	websocket.Upgrader
 }
 
-func NewWsHandler(s *diffsync.Server) *WsHandler {
-	return &WsHandler{
+func NewWsHandler(s *diffsync.Server, origins *OriginChecker, auth *Authenticator) *WsHandler {
+	h := &WsHandler{
 		Upgrader: defaultUpgrader,
 		srv:      s,
-		done:     make(chan struct{}),
+		auth:     auth,
+		conns:    newConnGroup(),
+	}
+	h.CheckOrigin = origins.Check
+	h.Subprotocols = supportedSubprotocols()
+	h.EnableCompression = *wsCompression
+	return h
+}
+
+// nextBatch encodes first and everything else queued in to_client within
+// the flush window (-batch_window) into a list of messages to be muxed into
+// a single frame. A batch holds at most -batch_max messages; further events
+// are only added while the batch is smaller than -batch_bytes.
+func nextBatch(c Codec, first outEvent, to_client chan outEvent) ([][]byte, error) {
+	msg, err := encodeOut(c, first)
+	if err != nil {
+		return nil, err
+	}
+	eventsSent.Inc(first.name())
+	msgs, size := [][]byte{msg}, len(msg)
+	flush := time.NewTimer(*batchWindow)
+	defer flush.Stop()
+batching:
+	for len(msgs) < *batchMax && size < *batchBytes {
+		select {
+		case oe, ok := <-to_client:
+			if !ok {
+				break batching
+			}
+			if msg, err = encodeOut(c, oe); err != nil {
+				return nil, err
+			}
+			eventsSent.Inc(oe.name())
+			msgs, size = append(msgs, msg), size+len(msg)
+		case <-flush.C:
+			break batching
+		}
 	}
+	batchSizes.Observe(float64(len(msgs)))
+	count("batches_sent")
+	return msgs, nil
 }
 
-func (h *WsHandler) Stop() {
+// Stop makes all connections flush their pending events and close with a
+// reconnect hint. It waits for the connections to finish until ctx expires.
+func (h *WsHandler) Stop(ctx context.Context) {
 	log.Println("ws: shutting down connections")
-	close(h.done)
-	h.wg.Wait()
+	if !h.conns.drain(ctx) {
+		log.Println("ws: drain period exceeded, giving up on remaining connections")
+		return
+	}
 	log.Println("ws: stopped")
 }
 
+// wsConn is the server side of a single WebSocket connection.
+type wsConn struct {
+	*websocket.Conn
+	info      *connInfo
+	codec     Codec
+	wire      *countingConn
+	compress  bool
+	to_client chan outEvent
+	// capture is nil unless traffic capture is enabled
+	capture *captureConn
+	// pings is only touched by the writing goroutine, pongs by the reader
+	pings, pongs int64
+}
+
+// writeBatch sends first and whatever else is queued in the connection's
+// to_client as a single frame. An error means the connection is unusable.
+func (c *wsConn) writeBatch(first outEvent) error {
+	msgs, err := nextBatch(c.codec, first, c.to_client)
+	if err != nil {
+		log.Println("received invalid event from system", err)
+		return err
+	}
+	return c.writeMsgs(msgs)
+}
+
+// writeMsgs sends msgs as a single message-list frame.
+func (c *wsConn) writeMsgs(msgs [][]byte) error {
+	muxed, err := c.codec.Mux(msgs)
+	if err != nil {
+		log.Println("could not mux outgoing messages into message-list", err)
+		return nil
+	}
+	// permessage-deflate is used if both sides agreed on it; frames smaller
+	// than -ws_compression_min are still sent uncompressed.
+	compressed := c.compress && len(muxed) >= *wsCompressionMin
+	c.EnableWriteCompression(compressed)
+	wireBefore := c.wire.BytesWritten()
+	c.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	if err = c.WriteMessage(c.codec.FrameType(), muxed); err != nil {
+		log.Printf("error writing to websocket connection %s: %v", c.info.ID, err)
+		return err
+	}
+	c.info.sent(len(msgs), len(muxed))
+	c.capture.Frame("out", muxed)
+	stats.Add("ws_bytes_out", int64(len(muxed)))
+	stats.Add("ws_bytes_out_wire", c.wire.BytesWritten()-wireBefore)
+	if compressed {
+		count("ws_frames_compressed")
+	} else {
+		count("ws_frames_uncompressed")
+	}
+	return nil
+}
+
+// flush sends all events currently queued in to_client.
+func (c *wsConn) flush() error {
+	for {
+		select {
+		case oe := <-c.to_client:
+			if err := c.writeBatch(oe); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
 func (h *WsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println("ws: incoming connection")
-	// TODO: check origin and other WS best-practices
-	conn, err := h.Upgrade(w, r, nil)
+	info := newConnInfo("ws", r.RemoteAddr, r.UserAgent())
+	log.Printf("ws: incoming connection %s from %s", info.ID, r.RemoteAddr)
+	// TODO: other WS best-practices
+	proto, codecName, err := negotiateProtocol(r, h.Subprotocols)
+	if err != nil {
+		log.Printf("ws: rejecting handshake of %s: %v", info.ID, err)
+		handshakeFailed("ws", "protocol")
+		rejectProtocol(w, err)
+		return
+	}
+	// checked here as well as by Upgrade, so that rejected origins can be
+	// told apart from other handshake failures
+	if !h.CheckOrigin(r) {
+		handshakeFailed("ws", "origin")
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	// authenticate before upgrading, so that rejected clients get a
+	// proper HTTP status
+	identity, err := h.auth.Authenticate(r)
+	if err != nil {
+		log.Printf("ws: rejecting handshake of %s: %v", info.ID, err)
+		handshakeFailed("ws", "auth")
+		rejectAuth(w, err)
+		return
+	}
+	if !h.conns.add() {
+		handshakeFailed("ws", "draining")
+		rejectBusy(w, errDraining)
+		return
+	}
+	defer h.conns.done()
+	ip := clientIP(r)
+	if err := acquireConn(ip); err != nil {
+		log.Printf("ws: rejecting handshake of %s: %v", info.ID, err)
+		handshakeFailed("ws", "busy")
+		rejectBusy(w, err)
+		return
+	}
+	defer caps.release(ip)
+	hj := &countingHijacker{ResponseWriter: w}
+	ws, err := h.Upgrade(hj, r, nil)
 	if _, ok := err.(websocket.HandshakeError); ok {
-		log.Println("websocket: handshake failed", err)
+		log.Printf("websocket: handshake of %s failed: %v", info.ID, err)
+		handshakeFailed("ws", "upgrade")
 		return
 	} else if err != nil {
 		return
 	}
-	h.wg.Add(1)
-	defer h.wg.Done()
-	defer func(c *websocket.Conn) {
-		if err := c.WriteControl(websocket.CloseMessage, []byte{}, time.Time{}); err != nil {
-			log.Println("ws: error sending websocket.CloseMessage", err)
+
+	info.wire = hj.conn
+	info.Identity = identity
+	registry.Add(info)
+	defer registry.Remove(info)
+
+	q := newQueue(func() { info.kick(closeResyncRequired, "resync required") })
+	conn := &wsConn{
+		Conn:      ws,
+		info:      info,
+		codec:     newVersionedCodec(proto, codecName),
+		wire:      hj.conn,
+		compress:  h.EnableCompression && strings.Contains(r.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"),
+		to_client: q.to_client,
+	}
+	conn.capture = capture.newCaptureConn(info, ip, r.URL.Path, proto.Version, conn.codec, codecName)
+	if conn.compress {
+		if err := conn.SetCompressionLevel(*wsCompressionLevel); err != nil {
+			log.Println("ws: invalid compression level", err)
+		}
+	}
+	conn.setupKeepalive()
+	if notice := deprecationMsg(proto); notice != nil {
+		log.Printf("ws: client %s uses deprecated protocol version %d", info.ID, proto.Version)
+		if msg, err := conn.codec.FromJSON(notice); err == nil {
+			conn.writeMsgs([][]byte{msg})
+		}
+	}
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	defer func(c *wsConn) {
+		if err := c.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second)); err != nil {
+			log.Printf("ws: error sending websocket.CloseMessage to %s: %v", c.info.ID, err)
 		}
 		c.Close()
+		c.capture.Close()
+		log.Printf("ws: connection %s (%s) closed; sent %d bytes payload, %d bytes on the wire (compression: %v)", c.info.ID, c.info.Identity, atomic.LoadInt64(&c.info.bytesOut), c.wire.BytesWritten(), c.compress)
 	}(conn)
 
-	from_client := make(chan diffsync.Event)
-	to_client := make(chan diffsync.Event, 16)
-	// inject only Client into Context passed down to server
-	ctx := diffsync.Context{
-		Client: diffsync.FuncHandler{func(event diffsync.Event) error {
-			select {
-			case to_client <- event:
-				return nil
-			case <-time.After(3 * time.Second):
-				return diffsync.EventTimeoutError{}
-			}
-		}}}
+	from_client := make(chan incoming)
+	limiter := newClientLimiter(r)
+	// sessions served by this connection, see resume.go; nil unless the
+	// client can resume its sessions
+	var sessions *sessionSet
+	if proto.Version >= 1 {
+		sessions = newSessionSet(q)
+		defer sessions.detachAll()
+	}
 
-	// fetch messages from WebSocket and pipe the into incoming pipe
-	go func(ch chan diffsync.Event) {
+	// fetch messages from WebSocket and pipe the into incoming pipe;
+	// malformed and throttled messages are reported to proto_errs.
+	proto_errs := make(chan protocolError)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func(ch chan incoming) {
 		defer close(ch)
+		report := func(perr protocolError) bool {
+			select {
+			case proto_errs <- perr:
+				return true
+			case <-quit:
+				return false
+			}
+		}
 		for {
 			_, msg, err := conn.ReadMessage()
 			if err != nil {
-				log.Println("error reading from websocket connection", err)
+				log.Printf("error reading from websocket connection %s: %v", info.ID, err)
 				return
 			}
-			msgs, err := adapter.Demux(msg)
+			conn.capture.Frame("in", msg)
+			msgs, err := conn.codec.Demux(msg)
 			if err != nil {
-				log.Println("error de-muxing message list from client")
+				log.Println("error de-muxing message list from client", err)
+				if !report(newProtocolError(errInvalidMsgList, nil, err)) {
+					return
+				}
 				continue
 			}
 			for i := range msgs {
-				event, err := adapter.MsgToEvent(msgs[i])
+				if sessions != nil {
+					jsonMsg, _ := conn.codec.ToJSON(msgs[i])
+					if ctrl, ok := parseControl(jsonMsg); ok {
+						info.received(ctrl.SID, len(msgs[i]))
+						sessions.control(ctrl)
+						continue
+					}
+				}
+				event, err := conn.codec.MsgToEvent(msgs[i])
 				if err != nil {
 					log.Println("invalid Message received", err)
-					// N.B. returning here means we're shutting the whole connection
-					// down in the event of a malformed incoming message.
-					// This might be rather drastic behaviour, but for now i'll keep
-					// it in so bug due to malformed data will die severly. in the
-					// hope to keep those bugs out for the release
+					jsonMsg, _ := conn.codec.ToJSON(msgs[i])
+					if !report(newProtocolError(errInvalidMsg, jsonMsg, err)) {
+						return
+					}
+					continue
+				}
+				info.received(event.SID, len(msgs[i]))
+				if !limiter.Allow(event.Name) {
+					jsonMsg, _ := conn.codec.ToJSON(msgs[i])
+					if !report(newProtocolError(errThrottled, jsonMsg, errRateLimited)) {
+						return
+					}
+					continue
+				}
+				if sessions != nil {
+					sessions.attach(event.SID)
+				}
+				in := newIncoming(event)
+				in.Context(clientContext(q, sessions, in.cid))
+				select {
+				case ch <- in:
+				case <-quit:
 					return
 				}
-				event.Context(ctx)
-				ch <- event
 			}
 		}
 	}(from_client)
+	protoErrors, violations := 0, 0
+	heartbeat := time.NewTicker(*pingInterval)
+	defer heartbeat.Stop()
 	for {
 		select {
-		case event, ok := <-from_client:
+		case in, ok := <-from_client:
 			if !ok {
 				// ws read failed, shutting down connection
 				return
 			}
-			log.Println("ws: received ", event)
-			if err := h.srv.Handle(event); err != nil {
-				log.Println("websocket: server could not handle incoming event", err)
-			}
-		case event, ok := <-to_client:
-			if !ok {
-				log.Println("error receiving from client, shutting down", err)
-				//shut. down. everything.
+			handleEvent(h.srv, info, in)
+		case perr := <-proto_errs:
+			msg, err := conn.codec.FromJSON(perr.Msg())
+			if err != nil {
+				log.Println("could not encode protocol error", err)
 				return
 			}
-			msg, err := adapter.EventToMsg(event)
-			if err != nil {
-				log.Println("received invalid event from system", err)
-				//shut. down. everything.
+			if err := conn.writeMsgs([][]byte{msg}); err != nil {
 				return
 			}
-			muxed, err := adapter.Mux([][]byte{msg})
-			if err != nil {
-				log.Println("could not mux outgoing messages into message-list", err)
+			if perr.Code == errThrottled {
+				if violations++; tooManyRateViolations(violations) {
+					log.Printf("ws: disconnecting client %s after %d rate limit violations", limiter.ip, violations)
+					closeMsg = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+					return
+				}
 				continue
 			}
-			if err = conn.WriteMessage(websocket.TextMessage, muxed); err != nil {
-				log.Println("error writing to websocket connection:", err)
+			protoErrors++
+			count("protocol_errors")
+			if tooManyProtocolErrors(protoErrors) {
+				log.Println("ws: disconnecting client after malformed message:", perr)
+				closeMsg = websocket.FormatCloseMessage(websocket.CloseProtocolError, "malformed message")
+				return
+			}
+		case oe, ok := <-q.to_client:
+			if !ok {
+				log.Println("error receiving from client, shutting down", err)
 				//shut. down. everything.
 				return
 			}
-		case <-time.After(30 * time.Second):
-			// heartbeat ping message evey 30s
+			if err := conn.writeBatch(oe); err != nil {
+				//shut. down. everything.
+				return
+			}
+		case <-heartbeat.C:
+			// heartbeat ping message every -ping_interval (30s by default)
 			// currently nginx is proxying between the client and hync's
 			// websocket handler. nginx has a defined proxy timeout of 60s
 			// after which it will close the connection to the proxy but not
 			// to the client.
 			// This hopefully tells nginx that hync's listener is still alive!
-			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Time{}); err != nil {
-				log.Println("ws: error sending websocket.PingMessage")
+			// The pongs tell us whether the client is.
+			if exp := checkExpired(info); exp != nil {
+				if exp.Reconnect {
+					// polite reconnect: deliver what's pending first
+					if err := conn.flush(); err != nil {
+						return
+					}
+				}
+				closeMsg = websocket.FormatCloseMessage(exp.Code, exp.Reason)
+				return
+			}
+			if err := conn.ping(); err != nil {
+				log.Printf("ws: error sending websocket.PingMessage to %s: %v", info.ID, err)
+				return
+			}
+		case <-info.kicked:
+			// e.g. the client fell behind and needs to rebuild its state,
+			// or an admin closed the connection
+			closeMsg = websocket.FormatCloseMessage(info.code, info.reason)
+			return
+		case <-h.conns.stopping():
+			// shutdown: deliver what's pending and tell the client when to
+			// come back
+			if err := conn.flush(); err != nil {
 				return
 			}
-		case <-h.done:
-			// shutdown
+			closeMsg = websocket.FormatCloseMessage(websocket.CloseServiceRestart, restartReason(retryAfter()))
 			return
 		}
 	}
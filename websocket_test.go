@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hiroapp-com/diffsync"
+)
+
+// testWsServer serves a WsHandler without sync server on /0/ws and /1/ws.
+func testWsServer(t *testing.T) (*WsHandler, *httptest.Server) {
+	origins, err := NewOriginChecker(OriginPolicy{AllowMissing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWsHandler(nil, origins, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/0/ws", h)
+	mux.Handle("/1/ws", h)
+	return h, httptest.NewServer(mux)
+}
+
+func dialWs(ts *httptest.Server, path string) (*websocket.Conn, *http.Response, error) {
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+	if err == nil {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	}
+	return ws, resp, err
+}
+
+func TestWsShutdown(t *testing.T) {
+	h, ts := testWsServer(t)
+	defer ts.Close()
+	ws, _, err := dialWs(ts, "/0/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.Stop(ctx)
+	assert(t, ctx.Err() == nil, "Stop should not wait for the drain period")
+	// the close frame has been sent by the time Stop returns
+	_, _, err = ws.ReadMessage()
+	assert(t, websocket.IsCloseError(err, websocket.CloseServiceRestart), "expected a restart close frame, got %v", err)
+	if ce, ok := err.(*websocket.CloseError); ok {
+		assert(t, strings.HasPrefix(ce.Text, "server-restarting"), "close frame without reconnect hint: %q", ce.Text)
+	}
+
+	_, resp, err := dialWs(ts, "/0/ws")
+	assert(t, err != nil && resp != nil && resp.StatusCode == http.StatusServiceUnavailable, "handshakes should be refused while draining: %v", err)
+}
+
+func TestNextBatch(t *testing.T) {
+	defer func(window time.Duration, max, bytes int) {
+		*batchWindow, *batchMax, *batchBytes = window, max, bytes
+	}(*batchWindow, *batchMax, *batchBytes)
+	*batchWindow, *batchMax, *batchBytes = 200*time.Millisecond, 3, 1<<20
+	c := newVersionedCodec(protocols[0], "json")
+	event := func(tag string) outEvent {
+		return outEvent{Event: diffsync.Event{Name: "res-sync", SID: "s", Tag: tag}}
+	}
+
+	to_client := make(chan outEvent, 8)
+	for _, tag := range []string{"2", "3", "4"} {
+		to_client <- event(tag)
+	}
+	msgs, err := nextBatch(c, event("1"), to_client)
+	assert(t, err == nil && len(msgs) == 3, "batch should be capped at -batch_max: %d messages, %v", len(msgs), err)
+	assert(t, len(to_client) == 1, "the rest should stay queued, %d left", len(to_client))
+
+	// events queued within the window join the batch
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		to_client <- event("6")
+	}()
+	msgs, _ = nextBatch(c, <-to_client, to_client)
+	assert(t, len(msgs) == 2, "event queued within the window should be batched, got %d messages", len(msgs))
+
+	// ... unless the batch is already big enough
+	*batchBytes = 1
+	to_client <- event("8")
+	msgs, _ = nextBatch(c, event("7"), to_client)
+	assert(t, len(msgs) == 1 && len(to_client) == 1, "batch should stop at -batch_bytes, got %d messages", len(msgs))
+}
+
+// counter returns the value of a counter in stats.
+func counter(name string) int64 {
+	if v, ok := stats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestWsCompression(t *testing.T) {
+	h, ts := testWsServer(t)
+	defer ts.Close()
+	dialer := websocket.Dialer{EnableCompression: true}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/0/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ws.Close()
+		h.conns.wait()
+	}()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// errors echo the tag, so a long tag makes a big answer
+	for _, tag := range []string{"small", strings.Repeat("compressible ", 100)} {
+		compressed, uncompressed := counter("ws_frames_compressed"), counter("ws_frames_uncompressed")
+		payload, wire := counter("ws_bytes_out"), counter("ws_bytes_out_wire")
+		ws.WriteMessage(websocket.TextMessage, []byte(`[{"name": 42, "tag": "`+tag+`"}]`))
+		_, frame, err := ws.ReadMessage()
+		if !assert(t, err == nil && strings.Contains(string(frame), tag), "expected an error echoing the tag, got %s, %v", frame, err) {
+			return
+		}
+		payload, wire = counter("ws_bytes_out")-payload, counter("ws_bytes_out_wire")-wire
+		assert(t, payload == int64(len(frame)), "payload bytes %d, expected %d", payload, len(frame))
+		if len(frame) < *wsCompressionMin {
+			assert(t, counter("ws_frames_uncompressed") == uncompressed+1, "small frame should be sent uncompressed")
+			assert(t, wire > payload, "uncompressed frame should take its payload plus framing on the wire, took %d bytes", wire)
+			continue
+		}
+		assert(t, counter("ws_frames_compressed") == compressed+1, "big frame should be compressed")
+		assert(t, wire < payload/2, "compressed frame took %d bytes on the wire for %d bytes payload", wire, payload)
+	}
+}
+
+func TestWsMissedPongs(t *testing.T) {
+	defer func(interval time.Duration, missed int) {
+		*pingInterval, *wsMaxMissedPongs = interval, missed
+	}(*pingInterval, *wsMaxMissedPongs)
+	*pingInterval, *wsMaxMissedPongs = 50*time.Millisecond, 2
+	h, ts := testWsServer(t)
+	defer ts.Close()
+
+	// answering pings keeps the connection open well beyond the missed
+	// pong limit, i.e. every pong resets the count
+	alive, _, err := dialWs(ts, "/0/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alive.SetReadDeadline(time.Now().Add(10 * *pingInterval))
+	_, _, err = alive.ReadMessage()
+	ne, ok := err.(net.Error)
+	assert(t, ok && ne.Timeout(), "client answering pings should stay connected, got %v", err)
+	alive.Close()
+
+	dead, _, err := dialWs(ts, "/0/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		dead.Close()
+		h.conns.wait()
+	}()
+	pings := 0
+	dead.SetPingHandler(func(string) error {
+		pings++
+		return nil
+	})
+	start := time.Now()
+	_, _, err = dead.ReadMessage()
+	assert(t, err != nil && pings == *wsMaxMissedPongs, "client not answering %d pings should be disconnected, got %v", pings, err)
+	assert(t, time.Since(start) < 10**pingInterval, "disconnect took %s", time.Since(start))
+}